@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation"
+	"github.com/naimoon6450/booksync/internal/config"
+	"github.com/naimoon6450/booksync/internal/exporter"
+	"github.com/naimoon6450/booksync/internal/snapshot"
+	"github.com/naimoon6450/booksync/internal/state"
+)
+
+// app holds the components shared by subcommands. Each command opens only
+// what it needs: the store for reading the library, and the vault (state and
+// exporter) for writing notes.
+type app struct {
+	ctx   context.Context
+	cfg   *config.Config
+	snap  *snapshot.Manager
+	store *annotation.Store
+	vault string
+	st    *state.File
+	exp   *exporter.Exporter
+}
+
+// newApp loads the configuration file and returns an app for a command.
+func newApp(ctx context.Context, configPath string) (*app, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return &app{ctx: ctx, cfg: cfg}, nil
+}
+
+// expandPath replaces ~ with the user's home directory.
+func expandPath(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current user: %w", err)
+	}
+	return filepath.Join(usr.HomeDir, path[1:]), nil
+}
+
+// resolveSources finds the live Apple Books databases from the configured
+// paths and pairs each with the path of its snapshot.
+func (a *app) resolveSources() (ann, lib snapshot.Source, err error) {
+	paths := a.cfg.Paths
+	basePathRaw := paths.Source.Base
+	log.Printf("Read config paths.source.base: %s", basePathRaw)
+	srcAnnDir := paths.Source.Annotation.Dir
+	log.Printf("Read config paths.source.annotation.dir: %s", srcAnnDir)
+	srcAnnFile := paths.Source.Annotation.File
+	log.Printf("Read config paths.source.annotation.file: %s", srcAnnFile)
+	srcLibDir := paths.Source.Library.Dir
+	log.Printf("Read config paths.source.library.dir: %s", srcLibDir)
+	srcLibFile := paths.Source.Library.File
+	log.Printf("Read config paths.source.library.file: %s", srcLibFile)
+	targetDirRaw := paths.Target.Dir
+	log.Printf("Read config paths.target.dir: %s", targetDirRaw)
+
+	if basePathRaw == "" || srcAnnDir == "" || srcAnnFile == "" || srcLibDir == "" || srcLibFile == "" || targetDirRaw == "" {
+		return ann, lib, fmt.Errorf("incomplete path configuration in config.yaml, please check keys under 'paths.source' and 'paths.target'")
+	}
+
+	srcBasePath, err := expandPath(basePathRaw)
+	if err != nil {
+		return ann, lib, fmt.Errorf("failed to expand source base path '%s': %w", basePathRaw, err)
+	}
+	targetDir, err := expandPath(targetDirRaw)
+	if err != nil {
+		return ann, lib, fmt.Errorf("failed to expand target directory '%s': %w", targetDirRaw, err)
+	}
+
+	// Construct source and destination paths
+	srcAnnPattern := filepath.Join(srcBasePath, srcAnnDir, srcAnnFile)
+	srcLibPattern := filepath.Join(srcBasePath, srcLibDir, srcLibFile)
+
+	srcAnnMatches, err := filepath.Glob(srcAnnPattern)
+	if err != nil || len(srcAnnMatches) == 0 {
+		return ann, lib, fmt.Errorf("error finding source annotation file matching pattern '%s' (or no matches found): %v", srcAnnPattern, err)
+	}
+	srcLibMatches, err := filepath.Glob(srcLibPattern)
+	if err != nil || len(srcLibMatches) == 0 {
+		return ann, lib, fmt.Errorf("error finding source library file matching pattern '%s' (or no matches found): %v", srcLibPattern, err)
+	}
+
+	ann = snapshot.Source{Path: srcAnnMatches[0], Dest: filepath.Join(targetDir, filepath.Base(srcAnnMatches[0]))}
+	lib = snapshot.Source{Path: srcLibMatches[0], Dest: filepath.Join(targetDir, filepath.Base(srcLibMatches[0]))}
+
+	log.Printf("Resolved Source Annotation DB: %s", ann.Path)
+	log.Printf("Resolved Source Library DB: %s", lib.Path)
+	log.Printf("Using Target Annotation DB: %s", ann.Dest)
+	log.Printf("Using Target Library DB: %s", lib.Dest)
+	return ann, lib, nil
+}
+
+// openStore snapshots the live databases if they changed and opens the store
+// on the snapshots.
+func (a *app) openStore() error {
+	ann, lib, err := a.resolveSources()
+	if err != nil {
+		return err
+	}
+
+	// Take fresh snapshots of the live databases (including their WAL files)
+	// whenever they changed since the last run.
+	a.snap = snapshot.New(ann, lib)
+	if _, err := a.snap.Refresh(a.ctx); err != nil {
+		return fmt.Errorf("failed to snapshot databases: %w", err)
+	}
+
+	orphans := make(map[string]annotation.BookInfo, len(a.cfg.OrphanedAssets))
+	for assetID, book := range a.cfg.OrphanedAssets {
+		orphans[assetID] = annotation.BookInfo{Title: book.Title, Author: book.Author}
+	}
+	a.store, err = annotation.NewStore(ann.Dest, lib.Dest, annotation.Options{
+		AttachAlias: a.cfg.DBObjects.AnnotationAttachAlias,
+		Orphans:     orphans,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+	return nil
+}
+
+// openState loads the sync state stored in the vault.
+func (a *app) openState(vault string) error {
+	if vault == "" {
+		return fmt.Errorf("the -vault flag is required")
+	}
+	vaultPath, err := expandPath(vault)
+	if err != nil {
+		return fmt.Errorf("failed to expand vault path '%s': %w", vault, err)
+	}
+	a.vault = vaultPath
+
+	a.st, err = state.Load(vaultPath)
+	if err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	return nil
+}
+
+// openVault loads the sync state and creates the exporter for a vault.
+func (a *app) openVault(vault, tpl string) error {
+	if err := a.openState(vault); err != nil {
+		return err
+	}
+
+	var err error
+	a.exp, err = a.newExporter(a.vault, tpl)
+	if err != nil {
+		return err
+	}
+	pathTpl := a.cfg.Export.Path
+	if pathTpl == "" {
+		pathTpl = exporter.DefaultPathTemplate
+	}
+	if a.st.PathTemplate == "" {
+		// Notes exported before paths were configurable used the default.
+		a.st.PathTemplate = exporter.DefaultPathTemplate
+	}
+	a.st.SetPathTemplate(pathTpl)
+	return nil
+}
+
+// newExporter creates an exporter for a vault with the configured options.
+// tpl overrides the configured template when set.
+func (a *app) newExporter(vault, tpl string) (*exporter.Exporter, error) {
+	opts, err := a.exporterOptions()
+	if err != nil {
+		return nil, err
+	}
+	exp, err := exporter.New(vault, a.template(tpl), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exporter: %w", err)
+	}
+	return exp, nil
+}
+
+// template returns the template to use: tpl if set, or the configured one.
+func (a *app) template(tpl string) string {
+	if tpl == "" {
+		return a.cfg.Export.Template
+	}
+	return tpl
+}
+
+// exporterOptions returns the exporter options set in the configuration.
+// Notes are tracked in the vault's state file once it has been opened.
+func (a *app) exporterOptions() (exporter.Options, error) {
+	templatesDir, err := expandPath(a.cfg.Export.TemplatesDir)
+	if err != nil {
+		return exporter.Options{}, fmt.Errorf("failed to expand templates directory '%s': %w", a.cfg.Export.TemplatesDir, err)
+	}
+	loc := time.Local
+	if tz := a.cfg.Export.Timezone; tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return exporter.Options{}, fmt.Errorf("invalid export.timezone: %w", err)
+		}
+	}
+	opts := exporter.Options{
+		OwnedKeys:      a.cfg.Export.Frontmatter.OwnedKeys,
+		ConflictPolicy: a.cfg.Export.Frontmatter.ConflictPolicy,
+		DeletionPolicy: a.cfg.Export.Deletions,
+		Order:          a.cfg.Export.Order,
+		PathTemplate:   a.cfg.Export.Path,
+		TemplateDir:    templatesDir,
+		Location:       loc,
+	}
+	if a.st != nil {
+		opts.Index = a.st
+	}
+	return opts, nil
+}
+
+func (a *app) close() {
+	if a.store != nil {
+		if err := a.store.Close(); err != nil {
+			log.Printf("Error closing store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gosimple/slug"
+	"github.com/naimoon6450/booksync/internal/annotation"
+)
+
+var booksCmd = &command{
+	name:  "books",
+	usage: "books [-v] [-config <file>]",
+	short: "List books with their highlight counts",
+	long:  `Lists every book that has highlights, with its asset ID and highlight count.`,
+	run:   runBooksCmd,
+}
+
+var showCmd = &command{
+	name:  "show",
+	usage: "show [-v] [-config <file>] <asset id | title>",
+	short: "Print the highlights of a book",
+	long: `Prints every highlight of a book. The book is matched by asset ID, then by
+title (case-insensitive), then by a unique partial title match.`,
+	run: runShowCmd,
+}
+
+var searchCmd = &command{
+	name:  "search",
+	usage: "search [-v] [-config <file>] <text>",
+	short: "Find highlights and notes containing some text",
+	long:  `Prints every highlight whose text or note contains the given text (case-insensitive).`,
+	run:   runSearchCmd,
+}
+
+// book groups the highlights of one asset for the read-only commands.
+type book struct {
+	AssetID    string
+	Title      string
+	Author     string
+	Highlights []*annotation.Highlight
+}
+
+// loadBooks reads every highlight and groups them by book, sorted by title.
+func loadBooks(ctx context.Context, configPath string) ([]*book, error) {
+	a, err := newApp(ctx, configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer a.close()
+	if err := a.openStore(); err != nil {
+		return nil, err
+	}
+
+	highlights, err := a.store.GetAllHighlights()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get highlights: %w", err)
+	}
+
+	byAsset := make(map[string]*book)
+	var books []*book
+	for _, h := range highlights {
+		b, ok := byAsset[h.AssetID]
+		if !ok {
+			b = &book{AssetID: h.AssetID, Title: h.BookTitle, Author: h.BookAuthor}
+			byAsset[h.AssetID] = b
+			books = append(books, b)
+		}
+		b.Highlights = append(b.Highlights, h)
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Title) < strings.ToLower(books[j].Title)
+	})
+	return books, nil
+}
+
+func runBooksCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("books", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	quietLogs(*verbose)
+
+	books, err := loadBooks(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ASSET ID\tHIGHLIGHTS\tTITLE\tAUTHOR")
+	for _, b := range books {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", b.AssetID, len(b.Highlights), b.Title, b.Author)
+	}
+	return tw.Flush()
+}
+
+func runShowCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	quietLogs(*verbose)
+
+	books, err := loadBooks(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+
+	b, err := findBook(books, strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s — %s (%s)\n\n", b.Title, b.Author, b.AssetID)
+	for _, h := range b.Highlights {
+		printHighlight(h)
+	}
+	return nil
+}
+
+// findBook matches a query against asset IDs, exact titles and then partial
+// titles, failing if a partial match is ambiguous.
+func findBook(books []*book, query string) (*book, error) {
+	for _, b := range books {
+		if b.AssetID == query {
+			return b, nil
+		}
+	}
+	for _, b := range books {
+		if strings.EqualFold(b.Title, query) || slug.Make(b.Title) == query {
+			return b, nil
+		}
+	}
+
+	var matches []*book
+	for _, b := range books {
+		if strings.Contains(strings.ToLower(b.Title), strings.ToLower(query)) {
+			matches = append(matches, b)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no book matches %q", query)
+	case 1:
+		return matches[0], nil
+	}
+
+	titles := make([]string, len(matches))
+	for i, b := range matches {
+		titles[i] = fmt.Sprintf("%s (%s)", b.Title, b.AssetID)
+	}
+	return nil, fmt.Errorf("%q matches several books: %s", query, strings.Join(titles, ", "))
+}
+
+func runSearchCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	quietLogs(*verbose)
+
+	books, err := loadBooks(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+
+	query := strings.ToLower(strings.Join(fs.Args(), " "))
+	var found int
+	for _, b := range books {
+		var header bool
+		for _, h := range b.Highlights {
+			if !strings.Contains(strings.ToLower(h.HighlightText), query) && !strings.Contains(strings.ToLower(h.Note), query) {
+				continue
+			}
+			if !header {
+				fmt.Printf("%s — %s (%s)\n\n", b.Title, b.Author, b.AssetID)
+				header = true
+			}
+			printHighlight(h)
+			found++
+		}
+	}
+
+	if found == 0 {
+		fmt.Printf("No highlights match %q.\n", query)
+	}
+	return nil
+}
+
+func printHighlight(h *annotation.Highlight) {
+	fmt.Printf("- %s\n", strings.ReplaceAll(h.HighlightText, "\n", "\n  "))
+	if h.Note != "" {
+		fmt.Printf("  Note: %s\n", strings.ReplaceAll(h.Note, "\n", "\n  "))
+	}
+	meta := h.Colour()
+	if !h.CreatedAt.IsZero() {
+		meta += ", " + h.CreatedAt.Local().Format("2006-01-02")
+	}
+	fmt.Printf("  [%s]\n\n", meta)
+}
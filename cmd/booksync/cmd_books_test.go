@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+)
+
+func TestLoadBooks(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "emma", "Jane Austen")
+	fx.AddBook("A2", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "a"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", UUID: "H2", Text: "b"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H3", Text: "c"})
+	cfg := writeConfig(t, fx, t.TempDir(), "")
+
+	books, err := loadBooks(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 2 || books[0].Title != "Dune" || books[1].Title != "emma" {
+		t.Fatalf("books = %+v, want Dune then emma", books)
+	}
+	if n := len(books[1].Highlights); n != 2 || books[1].Author != "Jane Austen" {
+		t.Errorf("emma by %q has %d highlight(s), want 2 by Jane Austen", books[1].Author, n)
+	}
+}
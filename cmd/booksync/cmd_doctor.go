@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var doctorCmd = &command{
+	name:  "doctor",
+	usage: "doctor [-v] [-config <file>] [-vault <dir>] [-template <name|file>]",
+	short: "Check the configuration, databases, vault and template",
+	long: `Runs a series of checks and reports what is wrong, if anything: that the
+config file is found, the Apple Books databases resolve and can be
+snapshotted and queried, that the template renders a sample book, and,
+when given, that the vault is writable.`,
+	run: runDoctorCmd,
+}
+
+func runDoctorCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	vault, tpl := vaultFlags(fs)
+	configPath := configFlag(fs)
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	quietLogs(*verbose)
+
+	var failures int
+	check := func(name string, err error, detail string) bool {
+		if err != nil {
+			fmt.Printf("[FAIL] %s: %v\n", name, err)
+			failures++
+			return false
+		}
+		fmt.Printf("[ok]   %s%s\n", name, detail)
+		return true
+	}
+
+	a, err := newApp(ctx, *configPath)
+	if !check("config file", err, configDetail(a)) {
+		return fmt.Errorf("%d check(s) failed", failures)
+	}
+	defer a.close()
+
+	ann, lib, err := a.resolveSources()
+	if check("source databases", err, "") {
+		fmt.Printf("         %s\n         %s\n", ann.Path, lib.Path)
+
+		err := a.openStore()
+		if check("snapshot and store", err, "") {
+			highlights, err := a.store.GetAllHighlights()
+			check("highlights query", err, fmt.Sprintf(": %d highlight(s)", len(highlights)))
+		}
+	}
+
+	if *vault != "" {
+		err := a.openState(*vault)
+		if check("state file", err, "") {
+			fmt.Printf("         %d tracked annotation(s), %d book(s) queued for retry\n", len(a.st.Annotations), len(a.st.Failed))
+			for assetID, fb := range a.st.Failed {
+				fmt.Printf("         retry %s (%s): %d attempt(s), last error: %s\n", fb.Title, assetID, fb.Attempts, fb.LastError)
+			}
+			check("vault writable", vaultWritable(a.vault), ": "+a.vault)
+		}
+	}
+
+	_, err = a.newExporter(os.TempDir(), *tpl)
+	check("template", err, ": "+a.template(*tpl))
+
+	if failures > 0 {
+		return fmt.Errorf("%d check(s) failed", failures)
+	}
+	return nil
+}
+
+// vaultWritable checks that files can be created in the vault directory.
+func vaultWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".booksync-doctor-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(filepath.Clean(name))
+}
+
+// configDetail describes where the configuration was loaded from.
+func configDetail(a *app) string {
+	if a == nil {
+		return ""
+	}
+	if a.cfg.File == "" {
+		return ": none found, using defaults"
+	}
+	return ": " + a.cfg.File
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var resetStateCmd = &command{
+	name:  "reset-state",
+	usage: "reset-state -vault <dir> [-yes]",
+	short: "Forget what has been exported so the next sync re-exports everything",
+	long: `Deletes the vault's booksync_state.json. The next sync re-renders every
+book; hand-written content outside the managed region of each note is kept.`,
+	run: runResetStateCmd,
+}
+
+func runResetStateCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("reset-state", flag.ContinueOnError)
+	vault := fs.String("vault", "", "Path to Obsidian vault")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+
+	a := &app{ctx: ctx}
+	if err := a.openState(*vault); err != nil {
+		return err
+	}
+
+	if !*yes {
+		fmt.Printf("Reset sync state for %d annotation(s) in %s? [y/N] ", len(a.st.Annotations), a.st.Path)
+		var answer string
+		fmt.Scanln(&answer)
+		if answer != "y" && answer != "Y" {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+
+	if err := os.Remove(a.st.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state file %s: %w", a.st.Path, err)
+	}
+	fmt.Printf("Removed %s\n", a.st.Path)
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResetStateCmd(t *testing.T) {
+	vault := t.TempDir()
+	p := filepath.Join(vault, "booksync_state.json")
+	if err := os.WriteFile(p, []byte(`{"version": 2, "annotations": {}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runResetStateCmd(context.Background(), resetStateCmd, []string{"-vault", vault, "-yes"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("state file still exists: %v", err)
+	}
+	// Resetting a vault without state is not an error.
+	if err := runResetStateCmd(context.Background(), resetStateCmd, []string{"-vault", vault, "-yes"}); err != nil {
+		t.Error(err)
+	}
+	if err := runResetStateCmd(context.Background(), resetStateCmd, []string{"-yes"}); err == nil {
+		t.Error("reset-state without -vault succeeded")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	booksync "github.com/naimoon6450/booksync/internal/sync"
+)
+
+var syncCmd = &command{
+	name:  "sync",
+	usage: "sync -vault <dir> [-template <name|file>] [-config <file>]",
+	short: "Export new and changed highlights to the vault once",
+	long: `Snapshots the Apple Books databases if they changed, then re-renders every
+book whose highlights were added, changed or deleted since the last sync.
+Books that failed to export on a previous run are retried. Exits non-zero
+while any book remains queued for retry.`,
+	run: runSyncCmd,
+}
+
+func runSyncCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	vault, tpl := vaultFlags(fs)
+	configPath := configFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	// Check the vault and template before taking snapshots.
+	if err := a.openVault(*vault, *tpl); err != nil {
+		return err
+	}
+	if err := a.openStore(); err != nil {
+		return err
+	}
+
+	log.Println("Performing one-off sync...")
+	return a.sync()
+}
+
+// sync runs a single reconciliation pass between the library and the vault.
+func (a *app) sync() error {
+	res, err := booksync.New(a.store, a.st, a.exp).Run(a.ctx)
+	if err != nil {
+		return err
+	}
+	if n := len(res.Errors); n > 0 {
+		return fmt.Errorf("one-off sync completed with %d errors, %d book(s) queued for retry on the next run", n, res.Pending)
+	}
+	log.Printf("One-off sync completed successfully for %d book(s).", res.BooksWritten)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+)
+
+// writeConfig writes a configuration whose source databases are those of
+// fx, snapshotted into target, followed by extra settings, and returns its
+// path.
+func writeConfig(t *testing.T, fx *annotationtest.Library, target, extra string) string {
+	t.Helper()
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	cfg := fmt.Sprintf(`paths:
+  source:
+    base: %q
+    annotation:
+      dir: "."
+      file: "AEAnnotation*.sqlite"
+    library:
+      dir: "."
+      file: "BKLibrary*.sqlite"
+  target:
+    dir: %q
+%s`, filepath.Dir(fx.AnnotationPath), target, extra)
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte(cfg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSyncCmdFailsWhileBooksAreQueued(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer."})
+	cfg := writeConfig(t, fx, t.TempDir(), "")
+
+	// A file where the notes folder should be makes every export fail.
+	vault := t.TempDir()
+	blocker := filepath.Join(vault, "apple_books_sync")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-vault", vault, "-config", cfg}
+	err := runSyncCmd(context.Background(), syncCmd, args)
+	if err == nil || !strings.Contains(err.Error(), "1 book(s) queued for retry") {
+		t.Fatalf("sync with a failing book returned %v", err)
+	}
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSyncCmd(context.Background(), syncCmd, args); err != nil {
+		t.Fatalf("sync after the failure was fixed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(blocker, "dune.md")); err != nil {
+		t.Errorf("the retried book wasn't exported: %v", err)
+	}
+}
+
+func TestSyncCmdChecksFlagsBeforeSnapshotting(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	target := t.TempDir()
+	cfg := writeConfig(t, fx, target, "")
+
+	for _, args := range [][]string{
+		{"-config", cfg},
+		{"-config", cfg, "-vault", t.TempDir(), "-template", "no-such-template"},
+	} {
+		if err := runSyncCmd(context.Background(), syncCmd, args); err == nil {
+			t.Errorf("sync %v succeeded", args)
+		}
+	}
+	if entries, _ := os.ReadDir(target); len(entries) > 0 {
+		t.Errorf("databases were snapshotted before the flags were checked: %v", entries)
+	}
+}
+
+func TestSyncCmdRequiresFlags(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	cfg := writeConfig(t, fx, t.TempDir(), "")
+
+	for _, args := range [][]string{
+		{"-config", cfg},
+		{"-template", "obsidian", "-config", cfg},
+		{"-vault", t.TempDir(), "-template", "no-such-template", "-config", cfg},
+		{"-vault", t.TempDir(), "-config", "no-such-config.yaml"},
+		{"-unknown"},
+	} {
+		if err := runSyncCmd(context.Background(), syncCmd, args); err == nil {
+			t.Errorf("sync %v succeeded", args)
+		}
+	}
+}
+
+// TestSyncCmdNamesOrphanedAssets checks orphaned_assets end to end: the
+// config file lowercases asset IDs, which must still match.
+func TestSyncCmdNamesOrphanedAssets(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "9F2C6A8E", UUID: "H1", Text: "A scanned page."})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "B7D1", UUID: "H2", Text: "Another page."})
+	cfg := writeConfig(t, fx, t.TempDir(), `orphaned_assets:
+  "9F2C6A8E":
+    title: "Some Paper"
+    author: "Someone, Else"
+`)
+
+	vault := t.TempDir()
+	if err := runSyncCmd(context.Background(), syncCmd, []string{"-vault", vault, "-config", cfg}); err != nil {
+		t.Fatal(err)
+	}
+	for _, note := range []string{"apple_books_sync/some-paper.md", "apple_books_sync/Unknown books/b7d1.md"} {
+		if _, err := os.Stat(filepath.Join(vault, filepath.FromSlash(note))); err != nil {
+			t.Errorf("note missing: %v", err)
+		}
+	}
+}
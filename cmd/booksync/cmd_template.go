@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/exporter"
+)
+
+var templateCmd = &command{
+	name:  "template",
+	usage: "template <preview | check> [flags]",
+	short: "Preview or check a note template",
+	long: `Subcommands:
+
+  preview  Render a book with the template and print the note to stdout
+  check    Render edge-case sample books and report template errors
+
+Neither touches the vault or its sync state.`,
+	run: runTemplateCmd,
+}
+
+var templatePreviewCmd = &command{
+	name:  "template preview",
+	usage: "template preview [-v] [-config <file>] [-template <name|file>] [-book <asset id | title>]",
+	long: `Prints the note the template renders for a book, as it would be written to
+a vault without a note for it yet. The book is read from the Apple Books
+snapshot and matched like the show command does; without -book, a built-in
+sample book is rendered instead.`,
+	run: runTemplatePreviewCmd,
+}
+
+var templateCheckCmd = &command{
+	name:  "template check",
+	usage: "template check [-v] [-config <file>] [-template <name|file>]",
+	long: `Renders the template and the note path template for synthetic books
+covering edge cases (no author, multi-line text, Unicode, quotes and colons
+in titles, notes, deleted and archived highlights, no highlights), checks
+that their frontmatter is valid YAML, and reports each failure with the
+file, line and column that caused it.`,
+	run: runTemplateCheckCmd,
+}
+
+func runTemplateCmd(ctx context.Context, cmd *command, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "preview":
+			return templatePreviewCmd.run(ctx, templatePreviewCmd, args[1:])
+		case "check":
+			return templateCheckCmd.run(ctx, templateCheckCmd, args[1:])
+		case "-h", "-help", "--help":
+			fmt.Fprintf(os.Stderr, "Usage: booksync %s\n\n%s\n", cmd.usage, cmd.long)
+			return flag.ErrHelp
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Usage: booksync %s\n\n%s\n", cmd.usage, cmd.long)
+	return errUsage
+}
+
+func runTemplatePreviewCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("template preview", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	tpl := templateFlag(fs)
+	query := fs.String("book", "", "Asset ID or title of the book to render (default: a sample book)")
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	quietLogs(*verbose)
+
+	a, err := newApp(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+	exp, err := a.newExporter("", *tpl)
+	if err != nil {
+		return err
+	}
+
+	bookData := exporter.SampleBook()
+	if *query != "" {
+		books, err := loadBooks(ctx, *configPath)
+		if err != nil {
+			return err
+		}
+		b, err := findBook(books, *query)
+		if err != nil {
+			return err
+		}
+		bookData = exporter.BookData{
+			AssetID:    b.AssetID,
+			Title:      b.Title,
+			Author:     b.Author,
+			Highlights: make([]exporter.Highlight, 0, len(b.Highlights)),
+			LastSynced: time.Now(),
+		}
+		for _, h := range b.Highlights {
+			bookData.UnknownBook = h.UnknownBook
+			bookData.Highlights = append(bookData.Highlights, exporter.HighlightFrom(h))
+		}
+	}
+
+	note, err := exp.Render(bookData)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(note)
+	return err
+}
+
+func runTemplateCheckCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("template check", flag.ContinueOnError)
+	configPath := configFlag(fs)
+	tpl := templateFlag(fs)
+	verbose := verboseFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+	quietLogs(*verbose)
+
+	a, err := newApp(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+	opts, err := a.exporterOptions()
+	if err != nil {
+		return err
+	}
+	opts.SkipCheck = true
+	exp, err := exporter.New("", a.template(*tpl), opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checking template %s\n", a.template(*tpl))
+	var failures int
+	for _, c := range exporter.SampleCases() {
+		if err := exp.CheckCase(c); err != nil {
+			fmt.Printf("[FAIL] %v\n", err)
+			failures++
+			continue
+		}
+		fmt.Printf("[ok]   %s\n", c.Name)
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d case(s) failed", failures, len(exporter.SampleCases()))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+)
+
+func TestTemplateCheckCmd(t *testing.T) {
+	cfg := writeConfig(t, annotationtest.New(t, t.TempDir()), t.TempDir(), "")
+	broken := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(broken, []byte("{{ range .Highlights }}{{ .Page }}{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runTemplateCmd(context.Background(), templateCmd, []string{"check", "-config", cfg, "-template", "logseq"}); err != nil {
+		t.Errorf("check of a built-in template: %v", err)
+	}
+	err := runTemplateCmd(context.Background(), templateCmd, []string{"check", "-config", cfg, "-template", broken})
+	if err == nil || !strings.Contains(err.Error(), "case(s) failed") {
+		t.Errorf("check of a broken template returned %v", err)
+	}
+	if err := runTemplateCmd(context.Background(), templateCmd, []string{"lint"}); err == nil {
+		t.Error("unknown template subcommand succeeded")
+	}
+}
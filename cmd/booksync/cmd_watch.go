@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+
+	booksync "github.com/naimoon6450/booksync/internal/sync"
+	"github.com/naimoon6450/booksync/internal/watcher"
+)
+
+var watchCmd = &command{
+	name:  "watch",
+	usage: "watch -vault <dir> [-template <name|file>] [-config <file>]",
+	short: "Keep the vault in sync as highlights change",
+	long: `Watches the Apple Books databases and syncs whenever they change, and
+periodically regardless (see watch.debounce and watch.interval in
+config.yaml). Send SIGHUP to sync immediately. Stop with Ctrl+C.`,
+	run: runWatchCmd,
+}
+
+func runWatchCmd(ctx context.Context, cmd *command, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	vault, tpl := vaultFlags(fs)
+	configPath := configFlag(fs)
+	if err := parseFlags(cmd, fs, args); err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, *configPath)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	// Check the vault and template before taking snapshots.
+	if err := a.openVault(*vault, *tpl); err != nil {
+		return err
+	}
+	if err := a.openStore(); err != nil {
+		return err
+	}
+
+	log.Println("Watch mode enabled. Starting watcher...")
+	log.Println("Press Ctrl+C to stop.")
+
+	err = watcher.WatchAndSync(ctx, a.store, a.snap, booksync.New(a.store, a.st, a.exp), watcher.Options{
+		Debounce: a.cfg.Watch.Debounce,
+		Interval: a.cfg.Watch.Interval,
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	log.Println("Watcher stopped.")
+	return nil
+}
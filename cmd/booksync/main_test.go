@@ -0,0 +1,22 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLegacyArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-vault", "v", "-template", "t"}, []string{"sync", "-vault", "v", "-template", "t"}},
+		{[]string{"-vault", "v", "-watch", "-template", "t"}, []string{"watch", "-vault", "v", "-template", "t"}},
+		{[]string{"--watch=true", "-vault", "v"}, []string{"watch", "-vault", "v"}},
+	}
+	for _, tt := range tests {
+		if got := legacyArgs(tt.args); !slices.Equal(got, tt.want) {
+			t.Errorf("legacyArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
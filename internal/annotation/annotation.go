@@ -1,41 +1,203 @@
 package annotation
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"embed"
+	"encoding/hex"
 	"fmt"
+	"iter"
 	"log"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/spf13/viper"
 )
 
 //go:embed sql/*.sql
 var sqlFS embed.FS
 
+// coreDataEpoch is the reference date of Core Data timestamps, which Apple
+// Books stores as seconds since 2001-01-01 00:00:00 UTC.
+var coreDataEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Annotation styles as stored in ZANNOTATIONSTYLE.
+const (
+	StyleUnderline = 0
+	StyleGreen     = 1
+	StyleBlue      = 2
+	StyleYellow    = 3
+	StylePink      = 4
+	StylePurple    = 5
+)
+
+var styleColours = map[int]string{
+	StyleUnderline: "underline",
+	StyleGreen:     "green",
+	StyleBlue:      "blue",
+	StyleYellow:    "yellow",
+	StylePink:      "pink",
+	StylePurple:    "purple",
+}
+
 type Highlight struct {
 	PK            int64
+	UUID          string
+	AssetID       string
 	HighlightText string
+	Note          string
+	Style         int
+	IsUnderline   bool
+	CreatedAt     time.Time
+	ModifiedAt    time.Time
+	Location      string // EPUB CFI of the highlighted range
+	// LocationStart is ZPLLOCATIONRANGESTART, the start of the highlight in
+	// the book's text, or 0 if unknown. It orders highlights without a CFI.
+	LocationStart int64
 	BookTitle     string
 	BookAuthor    string
+	// UnknownBook is set when the asset is not in the library database (a
+	// PDF, a removed book or an asset that hasn't synced) and no title was
+	// configured for it. BookTitle then falls back to the asset ID.
+	UnknownBook bool
+}
+
+// ColourName returns the name of a highlight style's colour, or "unknown" for
+// styles this version of booksync doesn't recognise.
+func ColourName(style int) string {
+	if c, ok := styleColours[style]; ok {
+		return c
+	}
+	return "unknown"
+}
+
+// Colour returns the name of the highlight's colour.
+func (h *Highlight) Colour() string {
+	return ColourName(h.Style)
+}
+
+// Key returns the stable identity of the highlight. Apple Books assigns every
+// annotation a UUID that survives database rebuilds, unlike Z_PK.
+func (h *Highlight) Key() string {
+	if h.UUID != "" {
+		return h.UUID
+	}
+	return fmt.Sprintf("pk-%d", h.PK)
+}
+
+// Hash returns a digest of the highlight's user-visible content, used to
+// detect edits between syncs.
+func (h *Highlight) Hash() string {
+	sum := sha256.New()
+	for _, field := range []string{
+		h.AssetID,
+		h.HighlightText,
+		h.Note,
+		strconv.Itoa(h.Style),
+		strconv.FormatBool(h.IsUnderline),
+		h.Location,
+	} {
+		sum.Write([]byte(field))
+		sum.Write([]byte{0})
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// coreDataTime converts a Core Data timestamp into a time.Time. NULL
+// timestamps become the zero time.
+func coreDataTime(ts sql.NullFloat64) time.Time {
+	if !ts.Valid {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(ts.Float64)
+	return coreDataEpoch.Add(time.Duration(sec)*time.Second + time.Duration(frac*float64(time.Second)))
+}
+
+// DefaultAttachAlias is the schema name the annotation database is attached
+// under when Options.AttachAlias is empty.
+const DefaultAttachAlias = "AEAnnotation"
+
+// DefaultPageSize is the number of rows Highlights reads per query when
+// Options.PageSize is not set.
+const DefaultPageSize = 1000
+
+// BookInfo is the title and author assigned to an asset that is missing from
+// the library database.
+type BookInfo struct {
+	Title  string
+	Author string
+}
+
+// Options configures a Store.
+type Options struct {
+	// AttachAlias is the schema name the annotation database is attached to
+	// the library database under. Defaults to DefaultAttachAlias.
+	AttachAlias string
+	// PageSize is the number of rows Highlights reads per query. Defaults to
+	// DefaultPageSize.
+	PageSize int
+	// Orphans assigns titles and authors to assets missing from the library
+	// database, keyed by asset ID. Keys are matched case-insensitively.
+	Orphans map[string]BookInfo
+	// Logger receives progress and diagnostic messages. Defaults to the
+	// standard logger.
+	Logger *log.Logger
 }
 
 type Store struct {
-	db *sql.DB
+	mu       sync.RWMutex
+	db       *sql.DB
+	annPath  string
+	libPath  string
+	alias    string
+	pageSize int
+	orphans  map[string]BookInfo
+	log      *log.Logger
 }
 
-func NewStore(annPath, libPath string) (*Store, error) {
-	log.Printf("Opening main DB (BKLibrary): %s", libPath)
+// NewStore opens the library database at libPath read-only and attaches the
+// annotation database at annPath to it.
+func NewStore(annPath, libPath string, opts Options) (*Store, error) {
+	if opts.AttachAlias == "" {
+		opts.AttachAlias = DefaultAttachAlias
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+
+	db, err := openDB(annPath, libPath, opts.AttachAlias, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
 
-	// Only the attach alias is configurable, table names are hardcoded
-	// as they should be consistent across all macs
-	annAttachAlias := viper.GetString("db_objects.annotation_attach_alias")
-	if annAttachAlias == "" {
-		return nil, fmt.Errorf("annotation_attach_alias not configured in config.yaml under db_objects")
+	store := &Store{
+		db:       db,
+		annPath:  annPath,
+		libPath:  libPath,
+		alias:    opts.AttachAlias,
+		pageSize: opts.PageSize,
+		orphans:  make(map[string]BookInfo, len(opts.Orphans)),
+		log:      opts.Logger,
+	}
+	for assetID, info := range opts.Orphans {
+		store.orphans[strings.ToLower(assetID)] = info
 	}
 
+	return store, nil
+}
+
+// openDB opens the library database read-only and attaches the annotation
+// database to it.
+func openDB(annPath, libPath, annAttachAlias string, logger *log.Logger) (*sql.DB, error) {
+	logger.Printf("Opening main DB (BKLibrary): %s", libPath)
+
 	// Hardcoded table names - these should be consistent across all macs
 	const annTable = "ZAEANNOTATION"
 	const libAssetTable = "ZBKLIBRARYASSET"
@@ -45,25 +207,29 @@ func NewStore(annPath, libPath string) (*Store, error) {
 		return nil, fmt.Errorf("failed to open library database: %w", err)
 	}
 
+	// ATTACH only applies to the connection it runs on, so keep the pool to a
+	// single connection.
+	db.SetMaxOpenConns(1)
+
 	// Check if the library table exists and has data
 	var exists int
 	checkLibQuery := fmt.Sprintf("SELECT 1 FROM [%s] LIMIT 1", libAssetTable)
 	errCheckExists := db.QueryRow(checkLibQuery).Scan(&exists)
 	if errCheckExists != nil {
 		if errCheckExists == sql.ErrNoRows {
-			log.Printf("Warning: Table [%s] appears to be empty (no rows found). JOINs will not find book info.", libAssetTable)
+			logger.Printf("Warning: Table [%s] appears to be empty (no rows found). JOINs will not find book info.", libAssetTable)
 		} else {
-			log.Printf("Error checking for records in [%s]: %v", libAssetTable, errCheckExists)
+			logger.Printf("Error checking for records in [%s]: %v", libAssetTable, errCheckExists)
 			db.Close()
 			return nil, fmt.Errorf("failed to check existence in [%s]: %w", libAssetTable, errCheckExists)
 		}
 	} else {
-		log.Printf("Verified table [%s] is not empty.", libAssetTable)
+		logger.Printf("Verified table [%s] is not empty.", libAssetTable)
 	}
 
 	// Attach the annotation database
 	attachSQL := fmt.Sprintf("ATTACH DATABASE '%s' AS [%s]", annPath, annAttachAlias)
-	log.Printf("Attaching Annotation DB: %s", attachSQL)
+	logger.Printf("Attaching Annotation DB: %s", attachSQL)
 	if _, err = db.Exec(attachSQL); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to attach annotation database '%s' AS [%s]: %w", annPath, annAttachAlias, err)
@@ -74,28 +240,50 @@ func NewStore(annPath, libPath string) (*Store, error) {
 	checkAnnQuery := fmt.Sprintf("SELECT name FROM [%s].sqlite_master WHERE type='table' AND name='%s'", annAttachAlias, annTable)
 	errCheckAnn := db.QueryRow(checkAnnQuery).Scan(&tableName)
 	if errCheckAnn != nil {
-		log.Printf("Error checking for table [%s] in attached DB [%s] immediately after attach: %v", annTable, annAttachAlias, errCheckAnn)
+		logger.Printf("Error checking for table [%s] in attached DB [%s] immediately after attach: %v", annTable, annAttachAlias, errCheckAnn)
 	} else {
-		log.Printf("Successfully verified table [%s] exists in attached [%s] database.", tableName, annAttachAlias)
+		logger.Printf("Successfully verified table [%s] exists in attached [%s] database.", tableName, annAttachAlias)
 	}
 
-	store := &Store{
-		db: db,
+	return db, nil
+}
+
+// Reopen swaps the store's connection for a fresh one on the same paths. It
+// is called after a new snapshot has been moved into place; queries running
+// concurrently finish on the old connection before it is closed.
+func (s *Store) Reopen() error {
+	db, err := openDB(s.annPath, s.libPath, s.alias, s.log)
+	if err != nil {
+		return fmt.Errorf("failed to reopen store: %w", err)
 	}
 
-	return store, nil
+	s.mu.Lock()
+	old := s.db
+	s.db = db
+	s.mu.Unlock()
+
+	if err := closeDB(old, s.alias); err != nil {
+		s.log.Printf("Error closing previous store connection: %v", err)
+	}
+	s.log.Printf("Store reopened on fresh snapshot")
+	return nil
 }
 
 func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return closeDB(s.db, s.alias)
+}
+
+func closeDB(db *sql.DB, alias string) error {
 	// Detach database
-	detachSQL := fmt.Sprintf("DETACH DATABASE [%s]", viper.GetString("db_objects.annotation_attach_alias"))
-	if _, err := s.db.Exec(detachSQL); err != nil {
-		return fmt.Errorf("error detaching database [%s]: %w",
-			viper.GetString("db_objects.annotation_attach_alias"), err)
+	detachSQL := fmt.Sprintf("DETACH DATABASE [%s]", alias)
+	if _, err := db.Exec(detachSQL); err != nil {
+		return fmt.Errorf("error detaching database [%s]: %w", alias, err)
 	}
 
 	// Close database connection
-	if err := s.db.Close(); err != nil {
+	if err := db.Close(); err != nil {
 		return fmt.Errorf("failed to close database connection: %w", err)
 	}
 
@@ -115,16 +303,17 @@ func removeComments(sql string) string {
 	return withoutComments
 }
 
-// GetHighlightsSince fetches all highlights with a primary key greater than lastPK.
-func (s *Store) GetHighlightsSince(lastPK int64) ([]*Highlight, error) {
+// loadQuery reads an embedded SQL file and substitutes the attach alias and
+// table name placeholders so the query can be executed against the store.
+func (s *Store) loadQuery(name string) (string, error) {
 	// Get the query from embedded files
-	sqlBytes, err := sqlFS.ReadFile("sql/latest_highlights.sql")
+	sqlBytes, err := sqlFS.ReadFile("sql/" + name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read embedded SQL file: %w", err)
+		return "", fmt.Errorf("failed to read embedded SQL file %s: %w", name, err)
 	}
 
 	// Only the attach alias is configurable, table names are hardcoded
-	annAttachAlias := viper.GetString("db_objects.annotation_attach_alias")
+	annAttachAlias := s.alias
 
 	// Hardcoded table names - these should be consistent across all macs
 	const annTable = "ZAEANNOTATION"
@@ -142,27 +331,44 @@ func (s *Store) GetHighlightsSince(lastPK int64) ([]*Highlight, error) {
 	querySQL = strings.ReplaceAll(querySQL, "[ZBKLIBRARYASSET]", fmt.Sprintf("[%s]", libAssetTable))
 
 	// Trim whitespace and make sure it's properly formatted
-	querySQL = strings.TrimSpace(querySQL)
-
-	// For debugging
-	log.Printf("Executing GetHighlightsSince query with lastPK = %d", lastPK)
-	// log.Printf("Query: %s", querySQL)
+	return strings.TrimSpace(querySQL), nil
+}
 
-	rows, err := s.db.Query(querySQL, lastPK) // Pass lastPK as parameter
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute highlights query with lastPK %d: %w", lastPK, err)
+// resolveBook returns the title and author of an asset from the library
+// columns, falling back to the configured orphans and then to the asset ID.
+func (s *Store) resolveBook(assetID string, title, author sql.NullString) (info BookInfo, unknown bool) {
+	if title.Valid && title.String != "" {
+		return BookInfo{Title: title.String, Author: author.String}, false
 	}
-	defer rows.Close()
+	if info, ok := s.orphans[strings.ToLower(assetID)]; ok && info.Title != "" {
+		return info, false
+	}
+	return BookInfo{Title: assetID}, true
+}
 
+// scanHighlights reads every row of a highlights query into Highlight values.
+func (s *Store) scanHighlights(rows *sql.Rows) ([]*Highlight, error) {
 	var highlights []*Highlight
 	for rows.Next() {
 		var h Highlight
 		var pk int64 // Variable to scan PK into
-		var highlight, bookTitle, bookAuthor string
+		var assetID, highlight string
+		var uuid, note, location, bookTitle, bookAuthor sql.NullString
+		var style, isUnderline, locationStart sql.NullInt64
+		var created, modified sql.NullFloat64
 
 		errScan := rows.Scan(
 			&pk, // Scan the PK
+			&assetID,
+			&uuid,
 			&highlight,
+			&note,
+			&style,
+			&isUnderline,
+			&created,
+			&modified,
+			&location,
+			&locationStart,
 			&bookTitle,
 			&bookAuthor,
 		)
@@ -171,17 +377,181 @@ func (s *Store) GetHighlightsSince(lastPK int64) ([]*Highlight, error) {
 		}
 
 		h.PK = pk // Assign scanned PK
+		h.UUID = uuid.String
+		h.AssetID = assetID
 		h.HighlightText = highlight
-		h.BookTitle = bookTitle
-		h.BookAuthor = bookAuthor
+		h.Note = note.String
+		h.Style = int(style.Int64)
+		h.IsUnderline = isUnderline.Int64 != 0
+		h.CreatedAt = coreDataTime(created)
+		h.ModifiedAt = coreDataTime(modified)
+		h.Location = location.String
+		h.LocationStart = locationStart.Int64
+		book, unknown := s.resolveBook(assetID, bookTitle, bookAuthor)
+		h.BookTitle = book.Title
+		h.BookAuthor = book.Author
+		h.UnknownBook = unknown
 
 		highlights = append(highlights, &h)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating rows: %w", err)
 	}
 
-	log.Printf("Fetched %d highlights since PK %d", len(highlights), lastPK)
 	return highlights, nil
 }
+
+// GetHighlightsSince fetches all highlights with a primary key greater than lastPK.
+func (s *Store) GetHighlightsSince(lastPK int64) ([]*Highlight, error) {
+	querySQL, err := s.loadQuery("latest_highlights.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	// For debugging
+	s.log.Printf("Executing GetHighlightsSince query with lastPK = %d", lastPK)
+	// log.Printf("Query: %s", querySQL)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(querySQL, lastPK, -1) // Pass lastPK as parameter, without a page limit
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute highlights query with lastPK %d: %w", lastPK, err)
+	}
+	defer rows.Close()
+
+	highlights, err := s.scanHighlights(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Printf("Fetched %d highlights since PK %d", len(highlights), lastPK)
+	return highlights, nil
+}
+
+// Highlights streams every current highlight with a primary key greater than
+// afterPK, in primary key order. Rows are read in pages using keyset
+// pagination on Z_PK, so only one page is held in memory at a time and the
+// store can be reopened between pages. An error ends the iteration.
+func (s *Store) Highlights(afterPK int64) iter.Seq2[*Highlight, error] {
+	return func(yield func(*Highlight, error) bool) {
+		querySQL, err := s.loadQuery("latest_highlights.sql")
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		for {
+			page, err := s.highlightsPage(querySQL, afterPK)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, h := range page {
+				if !yield(h, nil) {
+					return
+				}
+			}
+			if len(page) < s.pageSize {
+				return
+			}
+			afterPK = page[len(page)-1].PK
+		}
+	}
+}
+
+// highlightsPage reads one page of highlights after afterPK.
+func (s *Store) highlightsPage(querySQL string, afterPK int64) ([]*Highlight, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(querySQL, afterPK, s.pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute highlights query after PK %d: %w", afterPK, err)
+	}
+	defer rows.Close()
+
+	return s.scanHighlights(rows)
+}
+
+// GetAllHighlights fetches every current highlight in the library.
+func (s *Store) GetAllHighlights() ([]*Highlight, error) {
+	return s.GetHighlightsSince(0)
+}
+
+// GetHighlightsForBook fetches every current highlight for a single book,
+// identified by its asset ID. It is used to re-render a complete note for a
+// book that received new highlights, rather than only the new ones.
+func (s *Store) GetHighlightsForBook(assetID string) ([]*Highlight, error) {
+	querySQL, err := s.loadQuery("book_highlights.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(querySQL, assetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute book highlights query for asset %s: %w", assetID, err)
+	}
+	defer rows.Close()
+
+	highlights, err := s.scanHighlights(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Printf("Fetched %d highlights for asset %s", len(highlights), assetID)
+	return highlights, nil
+}
+
+// GetDeletedHighlights fetches the annotations Apple Books has marked as
+// deleted but not yet purged from its database.
+func (s *Store) GetDeletedHighlights() ([]*Highlight, error) {
+	querySQL, err := s.loadQuery("deleted_highlights.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query(querySQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute deleted highlights query: %w", err)
+	}
+	defer rows.Close()
+
+	highlights, err := s.scanHighlights(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Printf("Fetched %d deleted highlights", len(highlights))
+	return highlights, nil
+}
+
+// GetBook looks up the title and author of a book by its asset ID. It is used
+// for books that no longer have any live highlights to take them from. Assets
+// missing from the library resolve like they do for highlights: to their
+// configured orphan entry, or to the asset ID with unknown set.
+func (s *Store) GetBook(assetID string) (book BookInfo, unknown bool, err error) {
+	querySQL, err := s.loadQuery("book_info.sql")
+	if err != nil {
+		return BookInfo{}, false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var t, a sql.NullString
+	err = s.db.QueryRow(querySQL, assetID).Scan(&t, &a)
+	if err != nil && err != sql.ErrNoRows {
+		return BookInfo{}, false, fmt.Errorf("failed to look up book for asset %s: %w", assetID, err)
+	}
+	book, unknown = s.resolveBook(assetID, t, a)
+	return book, unknown, nil
+}
@@ -0,0 +1,264 @@
+package annotation
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+)
+
+func openTestStore(t *testing.T, fx *annotationtest.Library, opts Options) *Store {
+	t.Helper()
+	s, err := NewStore(fx.AnnotationPath, fx.LibraryPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestGetHighlightsForBook(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddBook("A2", "Emma", "Jane Austen")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", Text: "first"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", Text: "other book"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", Text: "deleted", Deleted: true})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", Text: "second"})
+	s := openTestStore(t, fx, Options{})
+
+	// Only the newest highlight is new, but the book is read in full.
+	since, err := s.GetHighlightsSince(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 1 || since[0].HighlightText != "second" {
+		t.Fatalf("GetHighlightsSince(3) = %v, want only the second highlight", since)
+	}
+	highlights, err := s.GetHighlightsForBook(since[0].AssetID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range highlights {
+		if h.AssetID != "A1" || h.BookTitle != "Dune" || h.BookAuthor != "Frank Herbert" {
+			t.Errorf("highlight %q has book %s %q by %q", h.HighlightText, h.AssetID, h.BookTitle, h.BookAuthor)
+		}
+		got = append(got, h.HighlightText)
+	}
+	if len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("GetHighlightsForBook(A1) = %q, want [first second]", got)
+	}
+}
+
+func TestCoreDataTime(t *testing.T) {
+	tests := []struct {
+		ts   sql.NullFloat64
+		want time.Time
+	}{
+		{sql.NullFloat64{}, time.Time{}},
+		{sql.NullFloat64{Valid: true}, coreDataEpoch},
+		{sql.NullFloat64{Float64: 1.5, Valid: true}, coreDataEpoch.Add(1500 * time.Millisecond)},
+		{sql.NullFloat64{Float64: -0.25, Valid: true}, coreDataEpoch.Add(-250 * time.Millisecond)},
+		{sql.NullFloat64{Float64: 86400, Valid: true}, time.Date(2001, time.January, 2, 0, 0, 0, 0, time.UTC)},
+		{sql.NullFloat64{Float64: 757382400.75, Valid: true}, time.Date(2025, time.January, 1, 0, 0, 0, 750_000_000, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := coreDataTime(tt.ts); !got.Equal(tt.want) {
+			t.Errorf("coreDataTime(%v) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestStoreReadsDates(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	created := time.Date(2024, time.March, 9, 14, 30, 15, 250_000_000, time.UTC)
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "a", Created: created, Modified: created.Add(90 * time.Second)})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "b"})
+	fx.Exec("UPDATE ZAEANNOTATION SET ZANNOTATIONCREATIONDATE = NULL, ZANNOTATIONMODIFICATIONDATE = NULL WHERE ZANNOTATIONUUID = 'H2'")
+
+	highlights, err := openTestStore(t, fx, Options{}).GetHighlightsForBook("A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*Highlight)
+	for _, h := range highlights {
+		got[h.UUID] = h
+	}
+	// Sub-second precision survives the round trip through a float.
+	if h := got["H1"]; h == nil || h.CreatedAt.Sub(created).Abs() > time.Microsecond || (h.ModifiedAt.Sub(created)-90*time.Second).Abs() > time.Microsecond {
+		t.Errorf("H1 dates = %+v, want created %v", h, created)
+	}
+	if h := got["H2"]; h == nil || !h.CreatedAt.IsZero() || !h.ModifiedAt.IsZero() {
+		t.Errorf("H2 dates = %+v, want zero times for NULL", h)
+	}
+}
+
+func TestStoreReadsAnnotationFields(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "a", Note: "mine", Style: StylePink, Location: "epubcfi(/6/4!/4/2/1:0)"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "b", Style: StyleUnderline, LocationStart: 250})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H3", Text: "c", Style: 42})
+
+	highlights, err := openTestStore(t, fx, Options{}).GetHighlightsForBook("A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(highlights) != 3 {
+		t.Fatalf("got %d highlights, want 3", len(highlights))
+	}
+	tests := []struct {
+		uuid, note, location, colour string
+		start                        int64
+		underline                    bool
+	}{
+		{"H1", "mine", "epubcfi(/6/4!/4/2/1:0)", "pink", 0, false},
+		{"H2", "", "", "underline", 250, true},
+		{"H3", "", "", "unknown", 0, false},
+	}
+	for i, tt := range tests {
+		h := highlights[i]
+		if h.UUID != tt.uuid || h.Note != tt.note || h.Location != tt.location || h.LocationStart != tt.start || h.Colour() != tt.colour || h.IsUnderline != tt.underline {
+			t.Errorf("highlight %d = %s note %q location %q start %d colour %s underline %v; want %+v", i, h.UUID, h.Note, h.Location, h.LocationStart, h.Colour(), h.IsUnderline, tt)
+		}
+	}
+}
+
+func TestHighlightKeyAndHash(t *testing.T) {
+	h := Highlight{PK: 7, UUID: "H1", AssetID: "A1", HighlightText: "a", Note: "n", Style: StyleYellow}
+	if h.Key() != "H1" {
+		t.Errorf("Key() = %s, want the UUID", h.Key())
+	}
+	if noUUID := (Highlight{PK: 7}); noUUID.Key() != "pk-7" {
+		t.Errorf("Key() without UUID = %s, want pk-7", noUUID.Key())
+	}
+
+	moved := h
+	moved.PK = 8
+	if moved.Hash() != h.Hash() {
+		t.Error("Hash() depends on the primary key")
+	}
+	edits := []func(*Highlight){
+		func(h *Highlight) { h.HighlightText = "b" },
+		func(h *Highlight) { h.Note = "" },
+		func(h *Highlight) { h.Style = StylePink },
+		func(h *Highlight) { h.Location = "epubcfi(/6/4)" },
+		// Fields are separated, so moving text between them is an edit.
+		func(h *Highlight) { h.HighlightText, h.Note = "an", "" },
+	}
+	for i, edit := range edits {
+		e := h
+		edit(&e)
+		if e.Hash() == h.Hash() {
+			t.Errorf("edit %d doesn't change Hash()", i)
+		}
+	}
+}
+
+func TestGetDeletedHighlights(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "live"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "gone", Note: "mine", Deleted: true})
+	s := openTestStore(t, fx, Options{})
+
+	deleted, err := s.GetDeletedHighlights()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].UUID != "H2" || deleted[0].HighlightText != "gone" || deleted[0].Note != "mine" {
+		t.Errorf("GetDeletedHighlights() = %+v, want H2 with its content", deleted)
+	}
+
+	book, unknown, err := s.GetBook("A1")
+	if err != nil || book != (BookInfo{Title: "Dune", Author: "Frank Herbert"}) || unknown {
+		t.Errorf("GetBook(A1) = %+v, %v, %v", book, unknown, err)
+	}
+}
+
+func TestStoreResolvesOrphans(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "a"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "9F2C6A8E", UUID: "H2", Text: "b"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "b7d1", UUID: "H3", Text: "c"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "MISSING", UUID: "H4", Text: "d"})
+
+	// Keys come lowercased from the config file and match asset IDs in any
+	// case. A title in the library wins over a configured one.
+	s := openTestStore(t, fx, Options{Orphans: map[string]BookInfo{
+		"9f2c6a8e": {Title: "Some Paper", Author: "Someone, Else"},
+		"B7D1":     {Title: "Notes"},
+		"a1":       {Title: "Not Dune"},
+		"missing":  {Author: "No title"},
+	}})
+
+	tests := []struct {
+		assetID     string
+		want        BookInfo
+		wantUnknown bool
+	}{
+		{"A1", BookInfo{Title: "Dune", Author: "Frank Herbert"}, false},
+		{"9F2C6A8E", BookInfo{Title: "Some Paper", Author: "Someone, Else"}, false},
+		{"b7d1", BookInfo{Title: "Notes"}, false},
+		// An entry without a title doesn't name the asset.
+		{"MISSING", BookInfo{Title: "MISSING"}, true},
+		{"NOHIGHLIGHTS", BookInfo{Title: "NOHIGHLIGHTS"}, true},
+	}
+	for _, tt := range tests {
+		book, unknown, err := s.GetBook(tt.assetID)
+		if err != nil || book != tt.want || unknown != tt.wantUnknown {
+			t.Errorf("GetBook(%s) = %+v, %v, %v; want %+v, %v", tt.assetID, book, unknown, err, tt.want, tt.wantUnknown)
+		}
+	}
+
+	// Highlights carry the same titles.
+	for h, err := range s.Highlights(0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		book, unknown, _ := s.GetBook(h.AssetID)
+		if h.BookTitle != book.Title || h.BookAuthor != book.Author || h.UnknownBook != unknown {
+			t.Errorf("highlight %s has book %q by %q (unknown %v), want %+v", h.UUID, h.BookTitle, h.BookAuthor, h.UnknownBook, book)
+		}
+	}
+}
+
+func TestHighlightsPages(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	for _, text := range []string{"one", "two", "three", "gone", "four", "five"} {
+		fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: text, Text: text, Deleted: text == "gone"})
+	}
+	s := openTestStore(t, fx, Options{PageSize: 2})
+
+	read := func(afterPK int64, limit int) []string {
+		t.Helper()
+		var texts []string
+		for h, err := range s.Highlights(afterPK) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			texts = append(texts, h.HighlightText)
+			if len(texts) == limit {
+				break
+			}
+		}
+		return texts
+	}
+
+	// Pages are read until one comes back short, skipping deleted rows.
+	if got := strings.Join(read(0, -1), " "); got != "one two three four five" {
+		t.Errorf("Highlights(0) = %s", got)
+	}
+	if got := strings.Join(read(3, -1), " "); got != "four five" {
+		t.Errorf("Highlights(3) = %s", got)
+	}
+	if got := strings.Join(read(0, 3), " "); got != "one two three" {
+		t.Errorf("Highlights(0) stopped after 3 = %s", got)
+	}
+}
@@ -0,0 +1,193 @@
+// Package annotationtest creates Apple Books databases for tests, with the
+// tables and columns the annotation store reads.
+package annotationtest
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// File names of the databases, as Apple Books names them.
+const (
+	AnnotationFile = "AEAnnotation_v10312011_1727_local.sqlite"
+	LibraryFile    = "BKLibrary-1-091020131601.sqlite"
+)
+
+const annotationSchema = `CREATE TABLE ZAEANNOTATION (
+	Z_PK INTEGER PRIMARY KEY,
+	ZANNOTATIONASSETID VARCHAR,
+	ZANNOTATIONSELECTEDTEXT VARCHAR,
+	ZANNOTATIONREPRESENTATIVETEXT VARCHAR,
+	ZANNOTATIONNOTE VARCHAR,
+	ZANNOTATIONSTYLE INTEGER,
+	ZANNOTATIONISUNDERLINE INTEGER,
+	ZANNOTATIONCREATIONDATE TIMESTAMP,
+	ZANNOTATIONMODIFICATIONDATE TIMESTAMP,
+	ZANNOTATIONUUID VARCHAR,
+	ZANNOTATIONLOCATION VARCHAR,
+	ZANNOTATIONDELETED INTEGER,
+	ZPLLOCATIONRANGESTART INTEGER,
+	ZANNOTATIONTYPE INTEGER
+)`
+
+const librarySchema = `CREATE TABLE ZBKLIBRARYASSET (
+	Z_PK INTEGER PRIMARY KEY,
+	ZASSETID VARCHAR,
+	ZSORTTITLE VARCHAR,
+	ZSORTAUTHOR VARCHAR,
+	ZTITLE VARCHAR,
+	ZAUTHOR VARCHAR
+)`
+
+// coreDataEpoch is the reference date of the timestamps Apple Books stores.
+var coreDataEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Highlight is an annotation row to insert.
+type Highlight struct {
+	AssetID       string
+	UUID          string
+	Text          string
+	Note          string
+	Style         int
+	Created       time.Time
+	Modified      time.Time
+	Location      string
+	LocationStart int64
+	Deleted       bool
+}
+
+// Library is a pair of annotation and library databases in a directory.
+type Library struct {
+	AnnotationPath string
+	LibraryPath    string
+
+	tb  testing.TB
+	ann *sql.DB
+	lib *sql.DB
+}
+
+// New creates empty databases in dir. They are closed when the test ends.
+func New(tb testing.TB, dir string) *Library {
+	tb.Helper()
+	l := &Library{
+		AnnotationPath: filepath.Join(dir, AnnotationFile),
+		LibraryPath:    filepath.Join(dir, LibraryFile),
+		tb:             tb,
+	}
+	l.ann = open(tb, l.AnnotationPath, annotationSchema)
+	l.lib = open(tb, l.LibraryPath, librarySchema)
+	tb.Cleanup(func() {
+		l.ann.Close()
+		l.lib.Close()
+	})
+	return l
+}
+
+func open(tb testing.TB, path, schema string) *sql.DB {
+	tb.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		tb.Fatalf("failed to create %s: %v", path, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		tb.Fatalf("failed to create schema in %s: %v", path, err)
+	}
+	return db
+}
+
+// AddBook adds a book to the library database.
+func (l *Library) AddBook(assetID, title, author string) {
+	l.tb.Helper()
+	if _, err := l.lib.Exec(`INSERT INTO ZBKLIBRARYASSET (ZASSETID, ZSORTTITLE, ZSORTAUTHOR, ZTITLE, ZAUTHOR) VALUES (?, ?, ?, ?, ?)`,
+		assetID, title, author, title, author); err != nil {
+		l.tb.Fatalf("failed to add book %s: %v", assetID, err)
+	}
+}
+
+// AddHighlight adds an annotation to the annotation database. Zero dates
+// default to the current time.
+func (l *Library) AddHighlight(h Highlight) {
+	l.tb.Helper()
+	if err := insertHighlight(l.ann, h); err != nil {
+		l.tb.Fatalf("failed to add highlight %s: %v", h.UUID, err)
+	}
+}
+
+// Exec runs a statement against the annotation database, to edit or delete
+// annotations.
+func (l *Library) Exec(query string, args ...any) {
+	l.tb.Helper()
+	if _, err := l.ann.Exec(query, args...); err != nil {
+		l.tb.Fatalf("failed to execute %q: %v", query, err)
+	}
+}
+
+// Generate adds books books with perBook highlights each, in one
+// transaction. Asset IDs are "asset-<n>" and highlight UUIDs
+// "asset-<n>-<m>".
+func (l *Library) Generate(books, perBook int) {
+	l.tb.Helper()
+	tx, err := l.ann.Begin()
+	if err != nil {
+		l.tb.Fatal(err)
+	}
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for b := range books {
+		assetID := fmt.Sprintf("asset-%d", b)
+		l.AddBook(assetID, fmt.Sprintf("Book %d", b), fmt.Sprintf("Author %d", b%50))
+		for h := range perBook {
+			err := insertHighlight(tx, Highlight{
+				AssetID:       assetID,
+				UUID:          fmt.Sprintf("%s-%d", assetID, h),
+				Text:          fmt.Sprintf("Highlight %d of book %d, long enough to look like a sentence someone would highlight.", h, b),
+				Style:         h % 6,
+				Created:       created.Add(time.Duration(b*perBook+h) * time.Minute),
+				Location:      fmt.Sprintf("epubcfi(/6/%d!/4/2/1,:%d,:%d)", 2+2*(h/20), h%20*10, h%20*10+9),
+				LocationStart: int64(h * 100),
+			})
+			if err != nil {
+				tx.Rollback()
+				l.tb.Fatalf("failed to generate highlights: %v", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		l.tb.Fatal(err)
+	}
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertHighlight(db execer, h Highlight) error {
+	now := time.Now()
+	if h.Created.IsZero() {
+		h.Created = now
+	}
+	if h.Modified.IsZero() {
+		h.Modified = h.Created
+	}
+	var note any
+	if h.Note != "" {
+		note = h.Note
+	}
+	_, err := db.Exec(`INSERT INTO ZAEANNOTATION (
+		ZANNOTATIONASSETID, ZANNOTATIONSELECTEDTEXT, ZANNOTATIONNOTE, ZANNOTATIONSTYLE,
+		ZANNOTATIONISUNDERLINE, ZANNOTATIONCREATIONDATE, ZANNOTATIONMODIFICATIONDATE,
+		ZANNOTATIONUUID, ZANNOTATIONLOCATION, ZANNOTATIONDELETED, ZPLLOCATIONRANGESTART, ZANNOTATIONTYPE
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 2)`,
+		h.AssetID, h.Text, note, h.Style, h.Style == 0, CoreDataTime(h.Created), CoreDataTime(h.Modified),
+		h.UUID, h.Location, h.Deleted, h.LocationStart)
+	return err
+}
+
+// CoreDataTime converts t to the timestamp Apple Books stores.
+func CoreDataTime(t time.Time) float64 {
+	return t.Sub(coreDataEpoch).Seconds()
+}
@@ -0,0 +1,33 @@
+-- Queries every non-deleted annotation for a single book, joining with book asset info.
+-- Used to re-render a complete note whenever a book receives new highlights.
+-- Note: The Go code will substitute the following placeholders before execution:
+--   [AEAnnotation] -> Configured annotation attach alias (e.g., from db_objects.annotation_attach_alias)
+--   [ZAEANNOTATION] -> Annotation table name
+--   [ZBKLIBRARYASSET] -> Library asset table name
+SELECT
+    A.Z_PK,
+    A.ZANNOTATIONASSETID                  AS asset_id,
+    A.ZANNOTATIONUUID                     AS uuid,
+    COALESCE(A.ZANNOTATIONSELECTEDTEXT,
+             A.ZANNOTATIONREPRESENTATIVETEXT) AS highlight,
+    A.ZANNOTATIONNOTE                     AS note,
+    A.ZANNOTATIONSTYLE                    AS style,
+    A.ZANNOTATIONISUNDERLINE              AS is_underline,
+    CAST(A.ZANNOTATIONCREATIONDATE AS REAL)     AS created, -- Core Data timestamp, cast so the driver does not parse it
+    CAST(A.ZANNOTATIONMODIFICATIONDATE AS REAL) AS modified,
+    A.ZANNOTATIONLOCATION                 AS location, -- EPUB CFI
+    A.ZPLLOCATIONRANGESTART               AS location_start, -- Position in the book, used when there is no CFI
+    B.ZSORTTITLE                          AS book_title,
+    B.ZSORTAUTHOR                         AS book_author
+FROM
+    [AEAnnotation].[ZAEANNOTATION] A
+LEFT JOIN
+    [ZBKLIBRARYASSET] B ON B.ZASSETID = A.ZANNOTATIONASSETID
+WHERE
+    A.ZANNOTATIONDELETED = 0
+  AND
+    A.ZANNOTATIONASSETID = ? -- Filter by book asset ID
+  AND
+    highlight IS NOT NULL
+ORDER BY
+    A.Z_PK ASC;
@@ -0,0 +1,11 @@
+-- Looks up the title and author of a single book by its asset ID.
+-- Note: The Go code will substitute the following placeholders before execution:
+--   [ZBKLIBRARYASSET] -> Library asset table name
+SELECT
+    B.ZSORTTITLE  AS book_title,
+    B.ZSORTAUTHOR AS book_author
+FROM
+    [ZBKLIBRARYASSET] B
+WHERE
+    B.ZASSETID = ?
+LIMIT 1;
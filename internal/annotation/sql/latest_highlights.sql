@@ -1,12 +1,22 @@
 -- Queries the most recent, non-deleted annotations SINCE a given PK, joining with book asset info.
+-- Results are keyset-paginated on Z_PK: the second parameter limits the page size (-1 for no limit).
 -- Note: The Go code will substitute the following placeholders before execution:
 --   [AEAnnotation] -> Configured annotation attach alias (e.g., from db_objects.annotation_attach_alias)
 --   [ZAEANNOTATION] -> Configured annotation table name (e.g., from db_objects.annotation_table)
 --   [ZBKLIBRARYASSET] -> Configured library asset table name (e.g., from db_objects.library_asset_table)
 SELECT
     A.Z_PK, -- Added Primary Key
+    A.ZANNOTATIONASSETID                  AS asset_id,
+    A.ZANNOTATIONUUID                     AS uuid,
     COALESCE(A.ZANNOTATIONSELECTEDTEXT,
              A.ZANNOTATIONREPRESENTATIVETEXT) AS highlight,
+    A.ZANNOTATIONNOTE                     AS note,
+    A.ZANNOTATIONSTYLE                    AS style,
+    A.ZANNOTATIONISUNDERLINE              AS is_underline,
+    CAST(A.ZANNOTATIONCREATIONDATE AS REAL)     AS created, -- Core Data timestamp, cast so the driver does not parse it
+    CAST(A.ZANNOTATIONMODIFICATIONDATE AS REAL) AS modified,
+    A.ZANNOTATIONLOCATION                 AS location, -- EPUB CFI
+    A.ZPLLOCATIONRANGESTART               AS location_start, -- Position in the book, used when there is no CFI
     B.ZSORTTITLE                          AS book_title,
     B.ZSORTAUTHOR                         AS book_author
 FROM
@@ -20,4 +30,5 @@ WHERE
   AND
     highlight IS NOT NULL
 ORDER BY
-    A.Z_PK ASC; -- Order by PK ascending to process in order
\ No newline at end of file
+    A.Z_PK ASC -- Order by PK ascending to process in order
+LIMIT ?;
\ No newline at end of file
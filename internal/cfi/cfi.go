@@ -0,0 +1,278 @@
+// Package cfi parses EPUB Canonical Fragment Identifiers, the locations
+// Apple Books stores for annotations, and orders them by their position in
+// the book.
+//
+// A CFI such as epubcfi(/6/4[chap01]!/4/2/1:12) is a path of steps through
+// the publication: the spine item, then (after the "!" indirection) the
+// elements of its content document, and finally a character offset. Range
+// CFIs, epubcfi(/6/4!/4/2,/1:0,/1:20), share a parent path and give the
+// start and end of the range relative to it.
+package cfi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Step is a step in a CFI path: the index of a child node, even for
+// elements and odd for the text between them.
+type Step struct {
+	Index int
+	// Indirect is set on the first step after a "!", which enters the
+	// content document referenced by the previous step.
+	Indirect bool
+}
+
+// Point is a location in the publication: the path to a node and, for text
+// nodes, a character offset within it.
+type Point struct {
+	Steps []Step
+	// Offset is the character offset in the last step, or -1 if the point
+	// has none.
+	Offset int
+}
+
+// CFI is a parsed EPUB CFI. For a range, Start is the start of the range
+// and End its end; otherwise both are the single location.
+type CFI struct {
+	Start Point
+	End   Point
+	Range bool
+}
+
+// Parse parses a CFI, with or without its epubcfi( ) wrapper. Assertions in
+// brackets and temporal or spatial offsets are checked for syntax and
+// otherwise ignored, as they don't affect the position.
+func Parse(s string) (CFI, error) {
+	body := strings.TrimSpace(s)
+	if strings.HasPrefix(body, "epubcfi(") {
+		if !strings.HasSuffix(body, ")") {
+			return CFI{}, fmt.Errorf("cfi %q: missing closing parenthesis", s)
+		}
+		body = body[len("epubcfi(") : len(body)-1]
+	}
+
+	p := &parser{s: body}
+	parent, err := p.path(true)
+	if err != nil {
+		return CFI{}, fmt.Errorf("cfi %q: %w", s, err)
+	}
+	if p.done() {
+		return CFI{Start: parent, End: parent}, nil
+	}
+
+	if !p.consume(',') {
+		return CFI{}, fmt.Errorf("cfi %q: unexpected %q at offset %d", s, p.s[p.i], p.i)
+	}
+	start, err := p.path(false)
+	if err != nil {
+		return CFI{}, fmt.Errorf("cfi %q: range start: %w", s, err)
+	}
+	if !p.consume(',') {
+		return CFI{}, fmt.Errorf("cfi %q: range without an end", s)
+	}
+	end, err := p.path(false)
+	if err != nil {
+		return CFI{}, fmt.Errorf("cfi %q: range end: %w", s, err)
+	}
+	if !p.done() {
+		return CFI{}, fmt.Errorf("cfi %q: unexpected %q at offset %d", s, p.s[p.i], p.i)
+	}
+	if parent.Offset >= 0 {
+		return CFI{}, fmt.Errorf("cfi %q: range parent has a character offset", s)
+	}
+	return CFI{Start: join(parent, start), End: join(parent, end), Range: true}, nil
+}
+
+// join appends a range start or end to the range's parent path.
+func join(parent, local Point) Point {
+	steps := make([]Step, 0, len(parent.Steps)+len(local.Steps))
+	steps = append(steps, parent.Steps...)
+	steps = append(steps, local.Steps...)
+	return Point{Steps: steps, Offset: local.Offset}
+}
+
+// Compare orders two CFIs by where they start in the publication, then by
+// where they end. It returns -1 if a comes first, 1 if b does and 0 if they
+// are at the same position.
+func Compare(a, b CFI) int {
+	if c := ComparePoints(a.Start, b.Start); c != 0 {
+		return c
+	}
+	return ComparePoints(a.End, b.End)
+}
+
+// ComparePoints orders two points in document order. A node comes before
+// the nodes it contains, and a missing offset counts as the start of the
+// node.
+func ComparePoints(a, b Point) int {
+	for i := 0; i < len(a.Steps) && i < len(b.Steps); i++ {
+		sa, sb := a.Steps[i], b.Steps[i]
+		if sa.Index != sb.Index {
+			return compareInts(sa.Index, sb.Index)
+		}
+		if sa.Indirect != sb.Indirect {
+			if sa.Indirect {
+				return 1
+			}
+			return -1
+		}
+	}
+	if len(a.Steps) != len(b.Steps) {
+		return compareInts(len(a.Steps), len(b.Steps))
+	}
+	return compareInts(max(a.Offset, 0), max(b.Offset, 0))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) done() bool { return p.i >= len(p.s) }
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.peek() == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// path parses steps up to an optional terminal offset. The parent path of a
+// CFI must start with a step; the start and end of a range may consist of
+// an offset alone.
+func (p *parser) path(needStep bool) (Point, error) {
+	pt := Point{Offset: -1}
+	indirect := false
+	for {
+		switch p.peek() {
+		case '/':
+			p.i++
+			n, err := p.integer()
+			if err != nil {
+				return pt, err
+			}
+			if err := p.assertion(); err != nil {
+				return pt, err
+			}
+			pt.Steps = append(pt.Steps, Step{Index: n, Indirect: indirect})
+			indirect = false
+			continue
+		case '!':
+			if len(pt.Steps) == 0 || indirect {
+				return pt, fmt.Errorf("misplaced indirection at offset %d", p.i)
+			}
+			p.i++
+			indirect = true
+			continue
+		}
+		break
+	}
+	if indirect {
+		return pt, fmt.Errorf("indirection without a step at offset %d", p.i)
+	}
+	if needStep && len(pt.Steps) == 0 {
+		return pt, fmt.Errorf("expected a step at offset %d", p.i)
+	}
+
+	if p.consume(':') {
+		n, err := p.integer()
+		if err != nil {
+			return pt, err
+		}
+		pt.Offset = n
+		if err := p.assertion(); err != nil {
+			return pt, err
+		}
+	}
+	// Temporal and spatial offsets only apply to audio, video and images.
+	if p.consume('~') {
+		if err := p.number(); err != nil {
+			return pt, err
+		}
+	}
+	if p.consume('@') {
+		if err := p.number(); err != nil {
+			return pt, err
+		}
+		if !p.consume(':') {
+			return pt, fmt.Errorf("expected ':' in spatial offset at offset %d", p.i)
+		}
+		if err := p.number(); err != nil {
+			return pt, err
+		}
+	}
+	if err := p.assertion(); err != nil {
+		return pt, err
+	}
+	if !needStep && len(pt.Steps) == 0 && pt.Offset < 0 {
+		return pt, fmt.Errorf("empty location at offset %d", p.i)
+	}
+	return pt, nil
+}
+
+func (p *parser) integer() (int, error) {
+	start := p.i
+	for !p.done() && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+		p.i++
+	}
+	if start == p.i {
+		return 0, fmt.Errorf("expected a number at offset %d", start)
+	}
+	n, err := strconv.Atoi(p.s[start:p.i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid number at offset %d: %w", start, err)
+	}
+	return n, nil
+}
+
+func (p *parser) number() error {
+	start := p.i
+	for !p.done() && (p.s[p.i] >= '0' && p.s[p.i] <= '9' || p.s[p.i] == '.') {
+		p.i++
+	}
+	if start == p.i {
+		return fmt.Errorf("expected a number at offset %d", start)
+	}
+	return nil
+}
+
+// assertion skips a bracketed assertion such as [chap01] or [;s=b], in
+// which "^" escapes the next character.
+func (p *parser) assertion() error {
+	if !p.consume('[') {
+		return nil
+	}
+	start := p.i - 1
+	for !p.done() {
+		switch p.s[p.i] {
+		case '^':
+			p.i += 2
+			continue
+		case ']':
+			p.i++
+			return nil
+		}
+		p.i++
+	}
+	return fmt.Errorf("unterminated assertion at offset %d", start)
+}
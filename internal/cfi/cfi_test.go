@@ -0,0 +1,126 @@
+package cfi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pt builds a point from step indices; a negative index marks the step as
+// indirect.
+func pt(offset int, steps ...int) Point {
+	p := Point{Offset: offset}
+	for _, n := range steps {
+		p.Steps = append(p.Steps, Step{Index: max(n, -n), Indirect: n < 0})
+	}
+	return p
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want CFI
+	}{
+		{"epubcfi(/6/4!/4/2/1:12)", CFI{Start: pt(12, 6, 4, -4, 2, 1), End: pt(12, 6, 4, -4, 2, 1)}},
+		{"/6/4!/4", CFI{Start: pt(-1, 6, 4, -4), End: pt(-1, 6, 4, -4)}},
+		{" epubcfi(/6/4) ", CFI{Start: pt(-1, 6, 4), End: pt(-1, 6, 4)}},
+		{"epubcfi(/6/4[chap01]!/4[body01]/10[para05]/3:10[yyy])", CFI{Start: pt(10, 6, 4, -4, 10, 3), End: pt(10, 6, 4, -4, 10, 3)}},
+		// "^" escapes brackets, commas and itself inside assertions.
+		{"epubcfi(/6/4[ch^]ap^,01^^]!/4:5)", CFI{Start: pt(5, 6, 4, -4), End: pt(5, 6, 4, -4)}},
+		{"epubcfi(/6/4!/4/2[;s=b])", CFI{Start: pt(-1, 6, 4, -4, 2), End: pt(-1, 6, 4, -4, 2)}},
+		{"epubcfi(/6/4!/4/2,/1:0,/3:20)", CFI{Start: pt(0, 6, 4, -4, 2, 1), End: pt(20, 6, 4, -4, 2, 3), Range: true}},
+		{"epubcfi(/6/4!/4/2/1,:5,:17)", CFI{Start: pt(5, 6, 4, -4, 2, 1), End: pt(17, 6, 4, -4, 2, 1), Range: true}},
+		{"epubcfi(/6/4!/4/2[x^,y],/1:0[a^]b],/1:3)", CFI{Start: pt(0, 6, 4, -4, 2, 1), End: pt(3, 6, 4, -4, 2, 1), Range: true}},
+		// Temporal and spatial offsets are accepted and ignored.
+		{"epubcfi(/6/4!/4/2~23.5@10:20.5)", CFI{Start: pt(-1, 6, 4, -4, 2), End: pt(-1, 6, 4, -4, 2)}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "expected a step"},
+		{"epubcfi(/6/4", "missing closing parenthesis"},
+		{"epubcfi(:12)", "expected a step"},
+		{"epubcfi(/6/x)", "expected a number"},
+		{"epubcfi(!/4)", "misplaced indirection"},
+		{"epubcfi(/6/4!!/4)", "misplaced indirection"},
+		{"epubcfi(/6/4!)", "indirection without a step"},
+		{"epubcfi(/6/4!:3)", "indirection without a step"},
+		{"epubcfi(/6/4[chap01)", "unterminated assertion"},
+		{"epubcfi(/6/4[chap01^])", "unterminated assertion"},
+		{"epubcfi(/6/4!/4/2,/1:0)", "range without an end"},
+		{"epubcfi(/6/4!/4/2,,/1:3)", "range start: empty location"},
+		{"epubcfi(/6/4!/4/2,/1:0,)", "range end: empty location"},
+		{"epubcfi(/6/4!/4/2:3,/1:0,/1:3)", "range parent has a character offset"},
+		{"epubcfi(/6/4!/4/2,/1:0,/1:3,/1:4)", "unexpected ','"},
+		{"epubcfi(/6/4 /2)", "unexpected ' '"},
+		{"epubcfi(/6/4@10)", "expected ':' in spatial offset"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.in)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error containing %q", tt.in, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %q, want it to contain %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"epubcfi(/6/4!/4/2/1:12)", "epubcfi(/6/4!/4/2/1:12)", 0},
+		{"epubcfi(/6/4!/4/2/1:3)", "epubcfi(/6/4!/4/2/1:12)", -1},
+		{"epubcfi(/6/4!/4/10/1:0)", "epubcfi(/6/4!/4/2/1:99)", 1},
+		{"epubcfi(/6/4!/4/2/1:99)", "epubcfi(/6/6!/4/2/1:0)", -1},
+		// Indices compare as numbers, not strings.
+		{"epubcfi(/6/10!/4)", "epubcfi(/6/4!/4)", 1},
+		// A node comes before the nodes it contains.
+		{"epubcfi(/6/4!/4/2)", "epubcfi(/6/4!/4/2/1:0)", -1},
+		// A missing offset counts as the start of the node.
+		{"epubcfi(/6/4!/4/2/1)", "epubcfi(/6/4!/4/2/1:0)", 0},
+		// Assertions don't affect the position.
+		{"epubcfi(/6/4[chap01]!/4/2/1:5)", "epubcfi(/6/4!/4/2/1:5)", 0},
+		// The content document of a spine item comes after the item's own
+		// children.
+		{"epubcfi(/6/4!/2)", "epubcfi(/6/4/2)", 1},
+		// Ranges compare by start, then by end.
+		{"epubcfi(/6/4!/4/2,/1:0,/1:20)", "epubcfi(/6/4!/4/2/1:5)", -1},
+		{"epubcfi(/6/4!/4/2,/1:5,/1:20)", "epubcfi(/6/4!/4/2,/1:5,/3:0)", -1},
+		{"epubcfi(/6/4!/4/2,/1:5,/1:20)", "epubcfi(/6/4!/4/2/1:5)", 1},
+		{"epubcfi(/6/4!/4/2/1,:5,:9)", "epubcfi(/6/4!/4/2,/1:5,/1:9)", 0},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Compare(a, b); got != tt.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(b, a); got != -tt.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package config loads booksync's configuration file into a typed Config.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config is the contents of config.yaml. See config.sample.yaml for what
+// each setting does.
+type Config struct {
+	// File is the path the configuration was read from, or empty if no
+	// config file was found and the defaults are in use.
+	File string `mapstructure:"-"`
+
+	Paths     Paths     `mapstructure:"paths"`
+	DBObjects DBObjects `mapstructure:"db_objects"`
+	Export    Export    `mapstructure:"export"`
+	Watch     Watch     `mapstructure:"watch"`
+	// OrphanedAssets names annotated assets that are missing from the Apple
+	// Books library, keyed by asset ID.
+	OrphanedAssets map[string]Book `mapstructure:"orphaned_assets"`
+}
+
+type Paths struct {
+	Source Source `mapstructure:"source"`
+	Target Target `mapstructure:"target"`
+}
+
+// Source locates the live Apple Books databases.
+type Source struct {
+	Base       string   `mapstructure:"base"`
+	Annotation Database `mapstructure:"annotation"`
+	Library    Database `mapstructure:"library"`
+}
+
+// Database is a database file, found by matching File (a glob pattern)
+// inside Dir relative to the source base.
+type Database struct {
+	Dir  string `mapstructure:"dir"`
+	File string `mapstructure:"file"`
+}
+
+// Target is where snapshots of the source databases are kept.
+type Target struct {
+	Dir string `mapstructure:"dir"`
+}
+
+type DBObjects struct {
+	AnnotationAttachAlias string `mapstructure:"annotation_attach_alias"`
+}
+
+// Book is the title and author assigned to an orphaned asset.
+type Book struct {
+	Title  string `mapstructure:"title"`
+	Author string `mapstructure:"author"`
+}
+
+type Export struct {
+	// Template is the name of a note template or the path of a template
+	// file. The -template flag overrides it.
+	Template string `mapstructure:"template"`
+	// TemplatesDir holds user templates, which override the built-in
+	// templates of the same name.
+	TemplatesDir string `mapstructure:"templates_dir"`
+	// Timezone is the IANA time zone templates format dates in. Empty means
+	// the local time zone.
+	Timezone string `mapstructure:"timezone"`
+	// Path is the template for note paths, relative to the vault.
+	Path        string      `mapstructure:"path"`
+	Frontmatter Frontmatter `mapstructure:"frontmatter"`
+	Deletions   string      `mapstructure:"deletions"`
+	// Order is the order of highlights in notes: position, created or
+	// modified.
+	Order string `mapstructure:"order"`
+}
+
+type Frontmatter struct {
+	OwnedKeys      []string `mapstructure:"owned_keys"`
+	ConflictPolicy string   `mapstructure:"conflict_policy"`
+}
+
+type Watch struct {
+	Debounce time.Duration `mapstructure:"debounce"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// setDefaults registers the values used for settings missing from the
+// config file. They match config.sample.yaml.
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("paths.source.base", "~/Library/Containers/com.apple.iBooksX/Data/Documents")
+	v.SetDefault("paths.source.annotation.dir", "AEAnnotation")
+	v.SetDefault("paths.source.annotation.file", "AEAnnotation*.sqlite")
+	v.SetDefault("paths.source.library.dir", "BKLibrary")
+	v.SetDefault("paths.source.library.file", "BKLibrary*.sqlite")
+	v.SetDefault("paths.target.dir", "./data")
+	v.SetDefault("db_objects.annotation_attach_alias", "AEAnnotation")
+	v.SetDefault("export.template", "obsidian")
+	v.SetDefault("export.templates_dir", "./templates")
+}
+
+// Load reads the configuration at path. With an empty path it looks for
+// config.yaml in the current directory and falls back to the defaults if
+// there is none; an explicit path that doesn't exist is an error.
+func Load(path string) (*Config, error) {
+	v := viper.New()
+	setDefaults(v)
+
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath(".")
+	}
+
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if path != "" || !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		log.Printf("No config.yaml found in the current directory, using defaults. See config.sample.yaml to customise them.")
+	}
+
+	// Earlier sample configs nested db_objects under paths.
+	if !v.InConfig("db_objects.annotation_attach_alias") && v.IsSet("paths.db_objects.annotation_attach_alias") {
+		v.Set("db_objects.annotation_attach_alias", v.GetString("paths.db_objects.annotation_attach_alias"))
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", v.ConfigFileUsed(), err)
+	}
+	cfg.File = v.ConfigFileUsed()
+	return &cfg, nil
+}
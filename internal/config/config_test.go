@@ -0,0 +1,80 @@
+package config
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoad(t *testing.T) {
+	p := writeFile(t, t.TempDir(), `paths:
+  target:
+    dir: "/tmp/snapshots"
+export:
+  deletions: "archive"
+  frontmatter:
+    owned_keys: ["title", "author"]
+watch:
+  debounce: 5s
+`)
+	cfg, err := Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != p || cfg.Paths.Target.Dir != "/tmp/snapshots" || cfg.Export.Deletions != "archive" {
+		t.Errorf("Load(%s) = %+v", p, cfg)
+	}
+	if len(cfg.Export.Frontmatter.OwnedKeys) != 2 || cfg.Watch.Debounce != 5*time.Second {
+		t.Errorf("export and watch settings = %+v, %+v", cfg.Export, cfg.Watch)
+	}
+	// Settings missing from the file keep their defaults.
+	if cfg.Paths.Source.Annotation.File != "AEAnnotation*.sqlite" || cfg.DBObjects.AnnotationAttachAlias != "AEAnnotation" {
+		t.Errorf("defaults not applied: %+v", cfg)
+	}
+}
+
+func TestLoadLegacyAlias(t *testing.T) {
+	p := writeFile(t, t.TempDir(), `paths:
+  db_objects:
+    annotation_attach_alias: "Legacy"
+`)
+	cfg, err := Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.DBObjects.AnnotationAttachAlias; got != "Legacy" {
+		t.Errorf("alias = %q, want the one nested under paths", got)
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	// Without a config.yaml in the current directory the defaults are used,
+	// but an explicit path must exist.
+	t.Chdir(t.TempDir())
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.File != "" || cfg.Paths.Target.Dir != "./data" {
+		t.Errorf("Load(\"\") = %+v, want the defaults", cfg)
+	}
+	if _, err := Load("no-such-config.yaml"); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
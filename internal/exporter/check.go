@@ -0,0 +1,161 @@
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SampleCase is a synthetic book templates are checked against.
+type SampleCase struct {
+	Name string
+	Book BookData
+}
+
+// SampleCases returns the books templates are checked against: SampleBook,
+// followed by edge cases templates commonly get wrong. Deleted and archived
+// highlights are included whatever the deletion policy, so every branch of a
+// template is exercised.
+func SampleCases() []SampleCase {
+	sample := SampleBook()
+
+	noAuthor := SampleBook()
+	noAuthor.Author = ""
+
+	multiline := SampleBook()
+	multiline.Highlights = []Highlight{{
+		UUID:     "SAMPLE-ML",
+		AssetID:  multiline.AssetID,
+		Text:     "First paragraph of the passage.\n\nSecond paragraph,\nwrapped over two lines.",
+		Note:     "A note\nspanning lines.",
+		Colour:   "green",
+		Style:    1,
+		Created:  sample.LastSynced,
+		Modified: sample.LastSynced,
+	}}
+
+	unicode := SampleBook()
+	unicode.Title = "Les Misérables — 第一巻 📚"
+	unicode.Author = "Victor Hugo, Ñandú Ö'Brien"
+	unicode.Highlights = []Highlight{{
+		UUID:     "SAMPLE-U",
+		AssetID:  unicode.AssetID,
+		Text:     "« Même la nuit la plus sombre prendra fin » — שלום, こんにちは *_[]#|",
+		Note:     "Ünïcödé note ✓",
+		Colour:   "purple",
+		Style:    5,
+		Created:  sample.LastSynced,
+		Modified: sample.LastSynced,
+	}}
+
+	empty := SampleBook()
+	empty.Highlights = nil
+	empty.Archived = nil
+
+	unknown := SampleBook()
+	unknown.Title = unknown.AssetID
+	unknown.Author = ""
+	unknown.UnknownBook = true
+
+	quoted := SampleBook()
+	quoted.Title = `He said "hi": a\b #1 [draft]`
+	quoted.Author = "O'Brien: 'Jr.' \\ {ed.}"
+
+	undated := SampleBook()
+	undated.LastSynced = time.Time{}
+	for i := range undated.Highlights {
+		undated.Highlights[i].Created = time.Time{}
+		undated.Highlights[i].Modified = time.Time{}
+		undated.Highlights[i].DeletedAt = time.Time{}
+	}
+
+	return []SampleCase{
+		{"sample book", sample},
+		{"empty author", noAuthor},
+		{"multi-line text", multiline},
+		{"unicode", unicode},
+		{"quotes, colons and backslashes", quoted},
+		{"no highlights", empty},
+		{"book missing from the library", unknown},
+		{"highlights without dates", undated},
+	}
+}
+
+// TemplateError is a failure to render a sample book, located in the
+// template file that caused it.
+type TemplateError struct {
+	// Case is the name of the SampleCase that failed.
+	Case string
+	// File is where the failing template was read from: a file path, a
+	// built-in template or the export.path setting.
+	File string
+	// Line and Col locate the failure in File, or are 0 if unknown.
+	Line int
+	Col  int
+	Err  string
+}
+
+func (e *TemplateError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		loc += fmt.Sprintf(":%d:%d", e.Line, e.Col)
+	}
+	return fmt.Sprintf("%s: %s (rendering %s)", loc, e.Err, e.Case)
+}
+
+// execErrorPos matches the location text/template puts at the start of
+// execution errors: "template: name:line:col: message".
+var execErrorPos = regexp.MustCompile(`^template: ([^:]+):(\d+):(\d+): (.*)$`)
+
+// CheckCase renders a sample book with the note and path templates without
+// writing anything, and reports where the first failure occurred. The book
+// is rendered both as is, so every branch of the template runs, and as
+// WriteBook would render it, so frontmatter that isn't valid YAML is caught.
+func (e *Exporter) CheckCase(c SampleCase) error {
+	if err := e.tpl.Execute(&bytes.Buffer{}, c.Book); err != nil {
+		return templateError(c.Name, err, e.sources)
+	}
+	if _, _, err := e.render(c.Book); err != nil {
+		return templateError(c.Name, errors.Unwrap(err), e.sources)
+	}
+	if _, err := e.notePath(c.Book); err != nil {
+		return templateError(c.Name, errors.Unwrap(err), map[string]string{pageTemplate: "export.path", "path": "export.path"})
+	}
+	return nil
+}
+
+// templateError locates a template execution error in the file the failing
+// template was read from.
+func templateError(name string, err error, sources map[string]string) *TemplateError {
+	te := &TemplateError{Case: name, File: sources[pageTemplate], Err: err.Error()}
+	if m := execErrorPos.FindStringSubmatch(err.Error()); m != nil {
+		if file, ok := sources[m[1]]; ok {
+			te.File = file
+		}
+		te.Line, _ = strconv.Atoi(m[2])
+		te.Col, _ = strconv.Atoi(m[3])
+		te.Err = m[4]
+	}
+	return te
+}
+
+// Render returns the note the exporter would write for a book that has no
+// note yet, without touching the vault.
+func (e *Exporter) Render(bookData BookData) ([]byte, error) {
+	fm, body, err := e.render(bookData)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := mergeRegion(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	fm, _, err = mergeFrontmatter(nil, fm, e.ownedKeys, nil, e.policy)
+	if err != nil {
+		return nil, err
+	}
+	return joinFrontmatter(fm, merged), nil
+}
@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinsPassSampleCases(t *testing.T) {
+	for _, name := range Builtins() {
+		e, err := New(t.TempDir(), name, Options{SkipCheck: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range SampleCases() {
+			if err := e.CheckCase(c); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestCheckCase(t *testing.T) {
+	tests := []struct {
+		name     string
+		tpl      string
+		wantCase string
+		wantLine int
+		wantErr  string
+	}{
+		{
+			name:     "unknown field",
+			tpl:      "---\ntitle: {{ yaml .Title }}\n---\n{{ range .Highlights }}{{ .Colour }}{{ .Page }}{{ end }}\n",
+			wantCase: "sample book",
+			wantLine: 4,
+			wantErr:  "can't evaluate field Page",
+		},
+		{
+			name:     "book without highlights",
+			tpl:      "# {{ .Title }}\n\n> {{ (index .Highlights 0).Text }}\n",
+			wantCase: "no highlights",
+			wantLine: 3,
+			wantErr:  "out of range",
+		},
+		{
+			name:     "unquoted frontmatter",
+			tpl:      "---\ntitle: \"{{ .Title }}\"\n---\n# {{ .Title }}\n",
+			wantCase: "quotes, colons and backslashes",
+			wantErr:  "failed to parse rendered frontmatter",
+		},
+		{
+			name:     "frontmatter that isn't a mapping",
+			tpl:      "---\n- {{ .Title }}\n---\n",
+			wantCase: "sample book",
+			wantErr:  "frontmatter is not a YAML mapping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := filepath.Join(t.TempDir(), "note.tmpl")
+			if err := os.WriteFile(tpl, []byte(tt.tpl), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			e, err := New(t.TempDir(), tpl, Options{SkipCheck: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var first *TemplateError
+			for _, c := range SampleCases() {
+				if err := e.CheckCase(c); err != nil {
+					if !errors.As(err, &first) {
+						t.Fatalf("CheckCase returned %T, want *TemplateError", err)
+					}
+					break
+				}
+			}
+			if first == nil {
+				t.Fatal("no case failed")
+			}
+			if first.Case != tt.wantCase || first.File != tpl || first.Line != tt.wantLine || !strings.Contains(first.Err, tt.wantErr) {
+				t.Errorf("got %+v, want case %q in %s line %d with %q", first, tt.wantCase, tpl, tt.wantLine, tt.wantErr)
+			}
+
+			// New runs the same check.
+			if _, err := New(t.TempDir(), tpl, Options{}); err == nil {
+				t.Error("New accepted the template")
+			}
+		})
+	}
+}
+
+// TestCheckCaseLocatesPartials checks that a failure in an overridden
+// partial is reported in the partial's file, not the page's.
+func TestCheckCaseLocatesPartials(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "obsidian", "highlight.tmpl")
+	if err := os.MkdirAll(filepath.Dir(partial), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, []byte("- {{ .Text }}\n  {{ .Page }}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(t.TempDir(), "obsidian", Options{TemplateDir: dir, SkipCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var te *TemplateError
+	if err := e.CheckCase(SampleCases()[0]); !errors.As(err, &te) || te.File != partial || te.Line != 2 {
+		t.Errorf("CheckCase = %v, want an error in %s:2", err, partial)
+	}
+}
+
+func TestRender(t *testing.T) {
+	vault := t.TempDir()
+	e, err := New(vault, "obsidian", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := e.Render(SampleBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`asset_id: "SAMPLE-ASSET"`, RegionStart, "A highlighted passage.", RegionEnd} {
+		if !strings.Contains(string(note), want) {
+			t.Errorf("note doesn't contain %q:\n%s", want, note)
+		}
+	}
+	if entries, err := os.ReadDir(vault); err != nil || len(entries) != 0 {
+		t.Errorf("Render wrote to the vault: %v, %v", entries, err)
+	}
+}
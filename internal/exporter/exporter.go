@@ -1,77 +1,398 @@
 package exporter
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
+	"time"
 
-	"github.com/gosimple/slug"
+	"github.com/naimoon6450/booksync/internal/annotation"
 )
 
-// Highlight struct is no longer needed directly by the exporter logic
-// keeping it here might be useful if other parts of the codebase use it
-// If not, it can be removed later.
-// type Highlight struct {
-// 	ID         int64
-// 	BookTitle  string
-// 	BookAuthor string
-// 	Text       string
-// }
+// Highlight is a single annotation as exposed to templates.
+type Highlight struct {
+	// UUID is the annotation's ZANNOTATIONUUID, or its primary key as
+	// "pk-<n>" for the rare rows without one.
+	UUID      string
+	AssetID   string
+	Text      string
+	Note      string
+	Style     int
+	Colour    string
+	Underline bool
+	Created   time.Time
+	Modified  time.Time
+	Location  string // EPUB CFI of the highlighted range
+	// LocationStart is Apple Books' position of the highlight in the book,
+	// used for ordering when Location is missing or can't be parsed.
+	LocationStart int64
+	Deleted       bool
+	DeletedAt     time.Time
+}
+
+// HighlightFrom converts an annotation read from the store into its template
+// representation.
+func HighlightFrom(h *annotation.Highlight) Highlight {
+	return Highlight{
+		UUID:          h.Key(),
+		AssetID:       h.AssetID,
+		Text:          h.HighlightText,
+		Note:          h.Note,
+		Style:         h.Style,
+		Colour:        h.Colour(),
+		Underline:     h.IsUnderline,
+		Created:       h.CreatedAt,
+		Modified:      h.ModifiedAt,
+		Location:      h.Location,
+		LocationStart: h.LocationStart,
+	}
+}
+
+// blockIDLen is the number of hex digits in block IDs: enough to tell the
+// highlights of a book apart, short enough to type.
+const blockIDLen = 8
+
+// BlockID returns the Obsidian block ID of the highlight, "bs-" followed by
+// a short digest of its UUID. It depends only on the UUID, so links to it
+// (![[Book#^bs-1a2b3c4d]]) survive re-syncs, re-ordering and title changes.
+// UUIDs are hashed rather than truncated because those created on one device
+// can share a prefix.
+func (h Highlight) BlockID() string {
+	if h.UUID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(h.UUID))
+	return "bs-" + hex.EncodeToString(sum[:])[:blockIDLen]
+}
+
+// OpenURL returns the ibooks:// URL that opens Apple Books at the highlight,
+// or at the start of its book when its location is unknown.
+func (h Highlight) OpenURL() string {
+	return openURL(h.AssetID, h.Location)
+}
+
+// parenEscaper escapes the parentheses URL escaping leaves in EPUB CFIs, so
+// the URLs can be used as Markdown link targets.
+var parenEscaper = strings.NewReplacer("(", "%28", ")", "%29")
+
+// openURL builds an ibooks://assetid/<id>#<cfi> URL. The CFI is escaped as a
+// URL fragment; an empty CFI opens the book where it was left.
+func openURL(assetID, cfi string) string {
+	if assetID == "" {
+		return ""
+	}
+	u := url.URL{Scheme: "ibooks", Host: "assetid", Path: "/" + assetID, Fragment: cfi}
+	return parenEscaper.Replace(u.String())
+}
 
 // BookData represents all highlights for a book
 type BookData struct {
-	Title      string
-	Author     string
-	Highlights []string
+	AssetID string
+	Title   string
+	Author  string
+	// UnknownBook is set for assets missing from the Apple Books library.
+	// Their Title is the asset ID and, with the default path template, their
+	// notes go to UnknownBooksDir.
+	UnknownBook bool
+	// Highlights holds the book's highlights, including deleted ones. The
+	// exporter applies its deletion policy before rendering.
+	Highlights []Highlight
+	// Archived holds deleted highlights when the deletion policy is
+	// DeletionArchive. It is filled in by the exporter.
+	Archived   []Highlight
+	LastSynced time.Time
+}
+
+// HighlightCount returns the number of highlights that aren't deleted, as
+// the deletion policy may keep tombstones in Highlights.
+func (b BookData) HighlightCount() int {
+	n := 0
+	for _, h := range b.Highlights {
+		if !h.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// OpenURL returns the ibooks:// URL that opens the book in Apple Books.
+func (b BookData) OpenURL() string {
+	return openURL(b.AssetID, "")
+}
+
+// Highlight orders, set with Options.Order.
+const (
+	// OrderPosition sorts highlights by where they are in the book.
+	OrderPosition = "position"
+	// OrderCreated sorts highlights by when they were made.
+	OrderCreated = "created"
+	// OrderModified sorts highlights by when they were last edited.
+	OrderModified = "modified"
+)
+
+// Deletion policies for highlights removed in Apple Books.
+const (
+	// DeletionRemove drops deleted highlights from the note.
+	DeletionRemove = "remove"
+	// DeletionStrikethrough keeps deleted highlights in place, flagged as
+	// deleted so the template can strike them through.
+	DeletionStrikethrough = "strikethrough"
+	// DeletionArchive moves deleted highlights to BookData.Archived.
+	DeletionArchive = "archive"
+)
+
+// Options controls how the exporter merges rendered notes with existing ones.
+type Options struct {
+	// OwnedKeys lists the frontmatter keys booksync updates. Defaults to
+	// DefaultOwnedKeys when empty.
+	OwnedKeys []string
+	// ConflictPolicy decides what happens when an owned key was changed in
+	// the note since booksync last wrote it: PolicyOverwrite (default),
+	// PolicyKeep or PolicyError.
+	ConflictPolicy string
+	// DeletionPolicy decides how deleted highlights are rendered:
+	// DeletionRemove (default), DeletionStrikethrough or DeletionArchive.
+	DeletionPolicy string
+	// Index records which note each book was written to and the owned
+	// frontmatter values written to it. When nil, notes are found by the
+	// asset_id in their frontmatter and edits to owned keys are only
+	// detected between writes by the same Exporter.
+	Index NoteIndex
+	// PathTemplate renders the path of each book's note, relative to the
+	// vault, from a PathData. Defaults to DefaultPathTemplate.
+	PathTemplate string
+	// TemplateDir holds user templates, looked up by name before the
+	// built-in ones.
+	TemplateDir string
+	// Location is the time zone the date template function formats dates
+	// in. Defaults to the local time zone.
+	Location *time.Location
+	// SkipCheck skips rendering SampleCases in New, for callers that check
+	// the template themselves with CheckCase.
+	SkipCheck bool
+	// Order decides the order of highlights in notes: OrderPosition
+	// (default), OrderCreated or OrderModified.
+	Order string
 }
 
 type Exporter struct {
 	vaultDir string
 	tpl      *template.Template
+	// sources maps the name of each template in tpl's set to where it was
+	// read from.
+	sources   map[string]string
+	ownedKeys map[string]bool
+	policy    string
+	deletions string
+	order     string
+	index     NoteIndex
+	pathTpl   *template.Template
+	// scanDir is the folder, relative to the vault, that every note rendered
+	// by the path template is written beneath.
+	scanDir string
+	// owners maps the notes beneath scanDir, keyed by noteKey, to the asset
+	// ID in their frontmatter. It is built on first use and kept up to date
+	// on writes.
+	owners map[string]noteFile
 }
 
-func New(vault, tplPath string) (*Exporter, error) {
-	tplBytes, err := os.ReadFile(tplPath)
+// New creates an exporter writing to vault. tpl is the name of a template or
+// the path of a template file or folder, as accepted by loadTemplate. The
+// template is checked against SampleCases so that mistakes are reported
+// before any note is written.
+func New(vault, tpl string, opts Options) (*Exporter, error) {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	funcs := funcMap(loc)
+
+	t, sources, err := loadTemplate(tpl, opts.TemplateDir, funcs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read template file %s: %w", tplPath, err)
+		return nil, err
+	}
+
+	keys := opts.OwnedKeys
+	if len(keys) == 0 {
+		keys = DefaultOwnedKeys
+	}
+	owned := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		owned[k] = true
+	}
+
+	policy := opts.ConflictPolicy
+	switch policy {
+	case "":
+		policy = PolicyOverwrite
+	case PolicyOverwrite, PolicyKeep, PolicyError:
+	default:
+		return nil, fmt.Errorf("unknown frontmatter conflict policy %q", policy)
+	}
+
+	deletions := opts.DeletionPolicy
+	switch deletions {
+	case "":
+		deletions = DeletionRemove
+	case DeletionRemove, DeletionStrikethrough, DeletionArchive:
+	default:
+		return nil, fmt.Errorf("unknown deletion policy %q", deletions)
+	}
+
+	order := opts.Order
+	switch order {
+	case "":
+		order = OrderPosition
+	case OrderPosition, OrderCreated, OrderModified:
+	default:
+		return nil, fmt.Errorf("unknown highlight order %q", order)
+	}
+
+	index := opts.Index
+	if index == nil {
+		index = memoryIndex{}
 	}
-	t, err := template.New("note").Parse(string(tplBytes))
+
+	pathTpl, err := parsePathTemplate(opts.PathTemplate, funcs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse template: %w", err)
+		return nil, err
+	}
+
+	e := &Exporter{
+		vaultDir:  vault,
+		tpl:       t,
+		sources:   sources,
+		ownedKeys: owned,
+		policy:    policy,
+		deletions: deletions,
+		order:     order,
+		index:     index,
+		pathTpl:   pathTpl,
+		scanDir:   staticDir(opts.PathTemplate),
+	}
+	if !opts.SkipCheck {
+		for _, c := range SampleCases() {
+			if err := e.CheckCase(c); err != nil {
+				return nil, err
+			}
+		}
 	}
-	return &Exporter{
-		vaultDir: vault,
-		tpl:      t,
-	}, nil
+	return e, nil
 }
 
-// WriteBook creates a directory for the book and writes its highlights to a highlights.md file.
+// WriteBook renders a book's highlights into the managed region of its note.
+// Content outside the region markers is preserved, and frontmatter emitted by
+// the template is merged into the note's existing frontmatter. The note is
+// replaced atomically so a failed write never leaves a partial file behind.
+//
+// Notes are identified by the book's asset ID, which is always written to the
+// frontmatter; the note's path is rendered from the path template and the
+// note is moved when the path changes.
 func (e *Exporter) WriteBook(bookData BookData) error {
-	bookKey := slug.Make(bookData.Title)
+	note, err := e.resolveNote(bookData)
+	if err != nil {
+		return err
+	}
+	bookFile := filepath.Join(e.vaultDir, filepath.FromSlash(note))
+	if err := os.MkdirAll(filepath.Dir(bookFile), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(bookFile), err)
+	}
 
-	// Create apple_books_sync base folder if it doesn't exist
-	appleBooksBaseDir := filepath.Join(e.vaultDir, "apple_books_sync")
-	if err := os.MkdirAll(appleBooksBaseDir, 0o755); err != nil {
-		return fmt.Errorf("failed to create apple_books_sync base directory %s: %w", appleBooksBaseDir, err)
+	renderedFM, renderedBody, err := e.render(bookData)
+	if err != nil {
+		return err
 	}
 
-	// Path to the book's markdown file within the base directory
-	bookFile := filepath.Join(appleBooksBaseDir, bookKey+".md")
+	existing, err := os.ReadFile(bookFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read book file %s: %w", bookFile, err)
+	}
+	existingFM, existingBody, _ := splitFrontmatter(existing)
+	if wholeNote(note, existingFM, existingBody, bookData.AssetID) {
+		// Written in full by booksync before it had managed regions: the
+		// region replaces the old highlights instead of following them.
+		existingBody = nil
+	}
 
-	// Open the file in create/truncate mode
-	// This will overwrite the file completely each time
-	f, err := os.OpenFile(bookFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	merged, err := mergeRegion(existingBody, renderedBody)
 	if err != nil {
-		return fmt.Errorf("failed to open book file %s: %w", bookFile, err)
+		return fmt.Errorf("refusing to write book file %s: %w", bookFile, err)
 	}
-	defer f.Close()
 
-	// Execute the template with the book data
-	err = e.tpl.Execute(f, bookData)
+	fm, hashes, err := mergeFrontmatter(existingFM, renderedFM, e.ownedKeys, e.index.Frontmatter(bookData.AssetID), e.policy)
 	if err != nil {
-		return fmt.Errorf("failed to execute template for book %s: %w", bookData.Title, err)
+		return fmt.Errorf("refusing to write book file %s: %w", bookFile, err)
 	}
+	merged = joinFrontmatter(fm, merged)
 
+	if err := writeFileAtomic(bookFile, merged); err != nil {
+		return err
+	}
+	e.owners[noteKey(note)] = noteFile{path: note, assetID: bookData.AssetID}
+	e.index.SetNotePath(bookData.AssetID, note)
+	e.index.SetFrontmatter(bookData.AssetID, hashes)
+	return nil
+}
+
+// render executes the template for a book after applying the deletion policy,
+// and splits the result into its frontmatter, which always carries the
+// book's asset ID, and its body.
+func (e *Exporter) render(bookData BookData) (fm, body []byte, err error) {
+	bookData = e.applyDeletionPolicy(bookData)
+	bookData.Highlights = sortHighlights(bookData.Highlights, e.order)
+	bookData.Archived = sortHighlights(bookData.Archived, e.order)
+
+	var rendered bytes.Buffer
+	if err := e.tpl.Execute(&rendered, bookData); err != nil {
+		return nil, nil, fmt.Errorf("failed to execute template for book %s: %w", bookData.Title, err)
+	}
+
+	fm, body, _ = splitFrontmatter(rendered.Bytes())
+	fm, err = withAssetID(fm, bookData.AssetID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("template for book %s: %w", bookData.Title, err)
+	}
+	return fm, body, nil
+}
+
+// applyDeletionPolicy filters, keeps or archives deleted highlights according
+// to the exporter's deletion policy.
+func (e *Exporter) applyDeletionPolicy(bookData BookData) BookData {
+	if e.deletions == DeletionStrikethrough {
+		return bookData
+	}
+
+	live := make([]Highlight, 0, len(bookData.Highlights))
+	var archived []Highlight
+	for _, h := range bookData.Highlights {
+		if !h.Deleted {
+			live = append(live, h)
+		} else if e.deletions == DeletionArchive {
+			archived = append(archived, h)
+		}
+	}
+	bookData.Highlights = live
+	bookData.Archived = archived
+	return bookData
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write temporary file %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmp, path, err)
+	}
 	return nil
 }
@@ -0,0 +1,95 @@
+package exporter
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestApplyDeletionPolicy(t *testing.T) {
+	book := BookData{AssetID: "A1", Title: "Dune", Highlights: []Highlight{
+		{UUID: "H1", Text: "kept"},
+		{UUID: "H2", Text: "gone", Deleted: true},
+		{UUID: "H3", Text: "also kept"},
+	}}
+	tests := []struct {
+		policy       string
+		wantLive     []string
+		wantArchived []string
+	}{
+		{DeletionRemove, []string{"H1", "H3"}, nil},
+		{DeletionStrikethrough, []string{"H1", "H2", "H3"}, nil},
+		{DeletionArchive, []string{"H1", "H3"}, []string{"H2"}},
+	}
+	uuids := func(hs []Highlight) []string {
+		var out []string
+		for _, h := range hs {
+			out = append(out, h.UUID)
+		}
+		return out
+	}
+	for _, tt := range tests {
+		got := (&Exporter{deletions: tt.policy}).applyDeletionPolicy(book)
+		if live := uuids(got.Highlights); !slices.Equal(live, tt.wantLive) {
+			t.Errorf("%s: highlights = %v, want %v", tt.policy, live, tt.wantLive)
+		}
+		if archived := uuids(got.Archived); !slices.Equal(archived, tt.wantArchived) {
+			t.Errorf("%s: archived = %v, want %v", tt.policy, archived, tt.wantArchived)
+		}
+	}
+	if len(book.Highlights) != 3 {
+		t.Error("applyDeletionPolicy modified its argument")
+	}
+}
+
+func TestBlockID(t *testing.T) {
+	a := Highlight{UUID: "9D3E1C2A-0B4F-4E7A-8C61-1F2E3D4C5B6A"}
+	b := Highlight{UUID: "9D3E1C2A-0B4F-4E7A-8C61-000000000000"}
+	id := a.BlockID()
+	if !regexp.MustCompile(`^bs-[0-9a-f]{8}$`).MatchString(id) {
+		t.Fatalf("BlockID() = %q", id)
+	}
+	if again := (Highlight{UUID: a.UUID, Text: "edited"}).BlockID(); again != id {
+		t.Errorf("BlockID changed with the text: %q, then %q", id, again)
+	}
+	if b.BlockID() == id {
+		t.Errorf("UUIDs sharing a prefix have the same block ID %q", id)
+	}
+	if got := (Highlight{}).BlockID(); got != "" {
+		t.Errorf("BlockID() without a UUID = %q", got)
+	}
+
+	e, err := New(t.TempDir(), "obsidian", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Text, b.Text = "First.", "Second."
+	note, err := e.Render(BookData{AssetID: "A1", Title: "Dune", Highlights: []Highlight{b, a}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^- First\..* \^` + id + `$`).Match(note) {
+		t.Errorf("block ID missing from\n%s", note)
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+	tests := []struct {
+		assetID, cfi string
+		want         string
+	}{
+		{"ASSET-1", "epubcfi(/6/4[chap01]!/4/2/1:0)", "ibooks://assetid/ASSET-1#epubcfi%28/6/4%5Bchap01%5D!/4/2/1:0%29"},
+		{"ASSET-1", "epubcfi(/6/4!/4/2[a^]b^,c]/1:0)", "ibooks://assetid/ASSET-1#epubcfi%28/6/4!/4/2%5Ba%5E%5Db%5E,c%5D/1:0%29"},
+		{"ASSET-1", "epubcfi(/6/4!/4/2,/1:0,/3:5)", "ibooks://assetid/ASSET-1#epubcfi%28/6/4!/4/2,/1:0,/3:5%29"},
+		{"ASSET-1", "epubcfi(/6/4[id%1]!/2)", "ibooks://assetid/ASSET-1#epubcfi%28/6/4%5Bid%251%5D!/2%29"},
+		{"A 1", "epubcfi(/6/4)", "ibooks://assetid/A%201#epubcfi%28/6/4%29"},
+		{"ASSET-1", "", "ibooks://assetid/ASSET-1"},
+		{"", "epubcfi(/6/4)", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := openURL(tt.assetID, tt.cfi); got != tt.want {
+			t.Errorf("openURL(%q, %q) = %s, want %s", tt.assetID, tt.cfi, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Conflict policies for owned frontmatter keys that were edited in a note:
+// their value differs from the one booksync last wrote there.
+const (
+	// PolicyOverwrite replaces the note's value with the rendered one.
+	PolicyOverwrite = "overwrite"
+	// PolicyKeep keeps the note's value; missing owned keys are still added.
+	PolicyKeep = "keep"
+	// PolicyError refuses to write the note.
+	PolicyError = "error"
+)
+
+// DefaultOwnedKeys are the frontmatter keys booksync updates when no list is
+// configured.
+var DefaultOwnedKeys = []string{"title", "author", "asset_id", "highlight_count", "last_synced"}
+
+const frontmatterDelim = "---"
+
+// splitFrontmatter separates a leading YAML frontmatter block from the rest
+// of a document. ok is false when the document has no frontmatter.
+func splitFrontmatter(doc []byte) (fm, rest []byte, ok bool) {
+	if !bytes.HasPrefix(doc, []byte(frontmatterDelim+"\n")) {
+		return nil, doc, false
+	}
+	body := doc[len(frontmatterDelim)+1:]
+
+	// The closing delimiter may directly follow the opening one (empty block).
+	if bytes.HasPrefix(body, []byte(frontmatterDelim+"\n")) {
+		return nil, body[len(frontmatterDelim)+1:], true
+	}
+
+	end := bytes.Index(body, []byte("\n"+frontmatterDelim+"\n"))
+	if end < 0 {
+		if bytes.HasSuffix(body, []byte("\n"+frontmatterDelim)) {
+			return body[:len(body)-len(frontmatterDelim)], nil, true
+		}
+		return nil, doc, false
+	}
+	return body[:end+1], body[end+len(frontmatterDelim)+2:], true
+}
+
+// joinFrontmatter reassembles a document from a frontmatter block and body.
+func joinFrontmatter(fm, rest []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(frontmatterDelim)
+	b.WriteByte('\n')
+	b.Write(fm)
+	if len(fm) > 0 && fm[len(fm)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	b.WriteString(frontmatterDelim)
+	b.WriteByte('\n')
+	b.Write(rest)
+	return b.Bytes()
+}
+
+// parseMapping parses a frontmatter block into a YAML mapping node. An empty
+// block yields an empty mapping.
+func parseMapping(fm []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(fm, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("frontmatter is not a YAML mapping")
+	}
+	return m, nil
+}
+
+// mergeFrontmatter updates the owned keys of existing with the values from
+// rendered, preserving every other key and the order they appear in. Keys
+// that are not owned are only taken from rendered when the note lacks them,
+// so template defaults never override user edits.
+//
+// written holds the hashes of the owned values booksync last wrote to the
+// note, as returned by a previous merge. An owned key was edited in the note
+// when its value no longer matches that hash, and only then does the
+// conflict policy apply; other owned keys are simply updated. Keys without a
+// recorded hash, in notes booksync hasn't written yet or after the state was
+// reset, are treated as unedited. The hashes of the owned values in the
+// merged frontmatter are returned for the next merge.
+func mergeFrontmatter(existing, rendered []byte, owned map[string]bool, written map[string]string, policy string) ([]byte, map[string]string, error) {
+	dst, err := parseMapping(existing)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse existing frontmatter: %w", err)
+	}
+	src, err := parseMapping(rendered)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse rendered frontmatter: %w", err)
+	}
+
+	hashes := make(map[string]string)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		idx := mappingIndex(dst, key.Value)
+		if idx < 0 {
+			dst.Content = append(dst.Content, key, value)
+			if owned[key.Value] {
+				hashes[key.Value] = hashNode(value)
+			}
+			continue
+		}
+		if !owned[key.Value] {
+			continue
+		}
+		current := dst.Content[idx+1]
+		if nodesEqual(current, value) {
+			hashes[key.Value] = hashNode(value)
+			continue
+		}
+
+		if prev, ok := written[key.Value]; ok && hashNode(current) != prev {
+			switch policy {
+			case PolicyKeep:
+				// The note's value wins. The hash of what booksync last
+				// wrote is kept, so the key stays edited on later syncs.
+				hashes[key.Value] = prev
+				continue
+			case PolicyError:
+				return nil, nil, fmt.Errorf("frontmatter key %q was changed in the note", key.Value)
+			}
+		}
+		// Keep comments attached to the user's value.
+		value.HeadComment = current.HeadComment
+		value.LineComment = current.LineComment
+		dst.Content[idx+1] = value
+		hashes[key.Value] = hashNode(value)
+	}
+
+	fm, err := encodeMapping(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fm, hashes, nil
+}
+
+// encodeMapping encodes a frontmatter mapping node.
+func encodeMapping(m *yaml.Node) ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		return nil, fmt.Errorf("failed to encode frontmatter: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode frontmatter: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// mappingIndex returns the index of key within a mapping node's content, or
+// -1 if it is absent.
+func mappingIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// nodesEqual reports whether two YAML nodes encode the same value.
+func nodesEqual(a, b *yaml.Node) bool {
+	var av, bv any
+	if err := a.Decode(&av); err != nil {
+		return false
+	}
+	if err := b.Decode(&bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// hashNode returns a short digest of the value a YAML node encodes, so values
+// compare equal whatever their quoting or formatting.
+func hashNode(n *yaml.Node) string {
+	var v any
+	if err := n.Decode(&v); err != nil {
+		return ""
+	}
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,223 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeFrontmatter(t *testing.T) {
+	owned := map[string]bool{"title": true, "highlight_count": true}
+	rendered := []byte("title: \"Dune\"\nhighlight_count: 2\nstatus: unread\n")
+	// What booksync wrote on the previous sync: title Dune, one highlight.
+	written := map[string]string{
+		"title":           hashNode(scalar(t, `"Dune"`)),
+		"highlight_count": hashNode(scalar(t, "1")),
+	}
+
+	tests := []struct {
+		name     string
+		existing string
+		written  map[string]string
+		policy   string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "new note",
+			existing: "",
+			policy:   PolicyError,
+			want:     "title: \"Dune\"\nhighlight_count: 2\nstatus: unread\n",
+		},
+		{
+			name:     "owned keys booksync wrote are updated under every policy",
+			existing: "title: Dune\nhighlight_count: 1\nrating: 5\n",
+			written:  written,
+			policy:   PolicyError,
+			want:     "title: Dune\nhighlight_count: 2\nrating: 5\nstatus: unread\n",
+		},
+		{
+			name:     "unedited keys are updated under keep",
+			existing: "title: Dune\nhighlight_count: 1\n",
+			written:  written,
+			policy:   PolicyKeep,
+			want:     "title: Dune\nhighlight_count: 2\nstatus: unread\n",
+		},
+		{
+			name:     "user keys are never overwritten",
+			existing: "title: Dune\nhighlight_count: 1\nstatus: reading\n",
+			written:  written,
+			policy:   PolicyOverwrite,
+			want:     "title: Dune\nhighlight_count: 2\nstatus: reading\n",
+		},
+		{
+			name:     "edited key is overwritten",
+			existing: "title: My Dune # mine\nhighlight_count: 1\n",
+			written:  written,
+			policy:   PolicyOverwrite,
+			want:     "title: \"Dune\" # mine\nhighlight_count: 2\nstatus: unread\n",
+		},
+		{
+			name:     "edited key is kept",
+			existing: "title: My Dune\nhighlight_count: 1\n",
+			written:  written,
+			policy:   PolicyKeep,
+			want:     "title: My Dune\nhighlight_count: 2\nstatus: unread\n",
+		},
+		{
+			name:     "edited key is an error",
+			existing: "title: My Dune\nhighlight_count: 1\n",
+			written:  written,
+			policy:   PolicyError,
+			wantErr:  `frontmatter key "title" was changed in the note`,
+		},
+		{
+			name:     "missing owned keys are added under keep",
+			existing: "rating: 5\n",
+			written:  written,
+			policy:   PolicyKeep,
+			want:     "rating: 5\ntitle: \"Dune\"\nhighlight_count: 2\nstatus: unread\n",
+		},
+		{
+			name:     "keys without a recorded value are treated as unedited",
+			existing: "title: My Dune\nhighlight_count: 1\n",
+			policy:   PolicyError,
+			want:     "title: \"Dune\"\nhighlight_count: 2\nstatus: unread\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, hashes, err := mergeFrontmatter([]byte(tt.existing), rendered, owned, tt.written, tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("frontmatter =\n%s\nwant\n%s", got, tt.want)
+			}
+			if _, ok := hashes["status"]; ok {
+				t.Errorf("hash recorded for a key that isn't owned")
+			}
+			if hashes["highlight_count"] != hashNode(scalar(t, "2")) {
+				t.Errorf("highlight_count hash not updated")
+			}
+		})
+	}
+}
+
+func TestMergeFrontmatterKeepStaysEdited(t *testing.T) {
+	owned := map[string]bool{"title": true}
+	written := map[string]string{"title": hashNode(scalar(t, "Dune"))}
+
+	// The kept value must still count as edited on the next merge, rather
+	// than being adopted as booksync's own.
+	for range 2 {
+		fm, hashes, err := mergeFrontmatter([]byte("title: My Dune\n"), []byte("title: Dune\n"), owned, written, PolicyKeep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fm) != "title: My Dune\n" {
+			t.Fatalf("frontmatter = %q, want the note's value", fm)
+		}
+		written = hashes
+	}
+}
+
+func TestHashNodeIgnoresFormatting(t *testing.T) {
+	if hashNode(scalar(t, "Dune")) != hashNode(scalar(t, `"Dune"`)) {
+		t.Error("quoted and plain scalars hash differently")
+	}
+	if hashNode(scalar(t, "1")) == hashNode(scalar(t, `"1"`)) {
+		t.Error("number and string hash the same")
+	}
+}
+
+// TestWriteBookConflictPolicies writes a book twice, as two syncs would,
+// then edits an owned key in the note and writes it a third time.
+func TestWriteBookConflictPolicies(t *testing.T) {
+	tpl := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(tpl, []byte("---\ntitle: \"{{ .Title }}\"\nhighlight_count: {{ len .Highlights }}\n---\n{{ range .Highlights }}- {{ .Text }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	book := BookData{AssetID: "A1", Title: "Dune", Highlights: []Highlight{{UUID: "H1", Text: "Fear is the mind-killer."}}}
+	more := book
+	more.Highlights = append(more.Highlights, Highlight{UUID: "H2", Text: "The spice must flow."})
+
+	tests := []struct {
+		policy    string
+		wantTitle string
+		wantErr   bool
+	}{
+		{PolicyOverwrite, "title: \"Dune\"", false},
+		{PolicyKeep, "title: My Dune", false},
+		{PolicyError, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			vault := t.TempDir()
+			e, err := New(vault, tpl, Options{ConflictPolicy: tt.policy, OwnedKeys: []string{"title", "highlight_count"}, SkipCheck: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			note := filepath.Join(vault, "apple_books_sync", "dune.md")
+
+			if err := e.WriteBook(book); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.WriteBook(more); err != nil {
+				t.Fatalf("second sync: %v", err)
+			}
+			if got := readFile(t, note); !strings.Contains(got, "highlight_count: 2\n") {
+				t.Fatalf("highlight_count not updated:\n%s", got)
+			}
+
+			edited := strings.Replace(readFile(t, note), `title: "Dune"`, "title: My Dune", 1)
+			edited += "\nMy own notes.\n"
+			if err := os.WriteFile(note, []byte(edited), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			more.LastSynced = time.Now()
+			err = e.WriteBook(more)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("edited owned key did not fail the write")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readFile(t, note)
+			if !strings.Contains(got, tt.wantTitle+"\n") || !strings.Contains(got, "My own notes.") {
+				t.Errorf("note =\n%s\nwant %s and the hand-written text", got, tt.wantTitle)
+			}
+		})
+	}
+}
+
+func scalar(t *testing.T, s string) *yaml.Node {
+	t.Helper()
+	m, err := parseMapping([]byte("v: " + s + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Content[1]
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
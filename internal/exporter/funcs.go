@@ -0,0 +1,230 @@
+package exporter
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gosimple/slug"
+	"github.com/naimoon6450/booksync/internal/annotation"
+	"gopkg.in/yaml.v3"
+)
+
+// funcMap returns the functions available to note and path templates. Dates
+// are formatted in loc unless a template asks for another time zone. Functions
+// take the value being transformed last, so they can end a pipeline:
+//
+//	{{ .Created | date "2006-01-02" }}
+//	{{ .Note | blockquote }}
+//	{{ .Author | default "Unknown author" }}
+//	title: {{ yaml .Title }}
+func funcMap(loc *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"date": func(layout string, t time.Time) string {
+			return formatDate(t, layout, loc)
+		},
+		"dateIn": func(tz, layout string, t time.Time) (string, error) {
+			l, err := time.LoadLocation(tz)
+			if err != nil {
+				return "", err
+			}
+			return formatDate(t, layout, l), nil
+		},
+		"blockquote": blockquote,
+		"mdEscape":   mdEscape,
+		"indent":     indent,
+		"indentRest": indentRest,
+		"wrap":       wrap,
+		"slug":       slug.Make,
+		"wikilink":   wikilink,
+		"join":       join,
+		"default":    defaultValue,
+		"colour":     colour,
+		"truncate":   truncate,
+		"yaml":       yamlValue,
+	}
+}
+
+// formatDate formats t in loc, or returns "" for the zero time so templates
+// don't print 0001-01-01 for highlights without a date.
+func formatDate(t time.Time, layout string, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(loc).Format(layout)
+}
+
+// blockquote turns text into a Markdown blockquote, quoting every line so
+// multi-line highlights stay inside the quote.
+func blockquote(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+var mdEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "~", `\~`, "=", `\=`,
+)
+
+// mdEscape escapes the characters Markdown (and Obsidian's extensions to it)
+// would otherwise treat as formatting.
+func mdEscape(s string) string {
+	return mdEscaper.Replace(s)
+}
+
+// indent prefixes every non-empty line of s with n spaces, for nesting text
+// under a list item.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// indentRest prefixes every non-empty line of s but the first with pad, so
+// multi-line text continues the list item or block it starts, as in a
+// "- {{ .Text | indentRest "  " }}" line.
+func indentRest(pad, s string) string {
+	first, rest, ok := strings.Cut(s, "\n")
+	if !ok {
+		return s
+	}
+	lines := strings.Split(rest, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return first + "\n" + strings.Join(lines, "\n")
+}
+
+// wrap breaks the lines of s at spaces so they are at most width characters
+// long. Words longer than width are left whole.
+func wrap(width int, s string) string {
+	var b strings.Builder
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		col := 0
+		for j, word := range strings.Fields(line) {
+			n := utf8.RuneCountInString(word)
+			if j > 0 {
+				if col+1+n > width {
+					b.WriteByte('\n')
+					col = 0
+				} else {
+					b.WriteByte(' ')
+					col++
+				}
+			}
+			b.WriteString(word)
+			col += n
+		}
+	}
+	return b.String()
+}
+
+// wikilink builds an Obsidian link to a note, with an optional display text.
+// Characters Obsidian doesn't allow in link targets are replaced.
+func wikilink(target string, alias ...string) string {
+	target = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("[]|#^", r) {
+			return '-'
+		}
+		return r
+	}, target)
+	if len(alias) > 0 && alias[0] != "" && alias[0] != target {
+		return "[[" + target + "|" + alias[0] + "]]"
+	}
+	return "[[" + target + "]]"
+}
+
+// join joins the elements of a slice, formatted with fmt.Sprint, with sep.
+func join(sep string, list any) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list, got %T", list)
+	}
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// defaultValue returns def when v is empty: the zero value of its type, or an
+// empty slice or map.
+func defaultValue(def, v any) any {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		if rv.Len() == 0 {
+			return def
+		}
+	default:
+		if rv.IsZero() {
+			return def
+		}
+	}
+	return v
+}
+
+// colour returns the colour name of a highlight style number. Names are
+// passed through, so it also accepts a Highlight's Colour.
+func colour(v any) (string, error) {
+	switch c := v.(type) {
+	case int:
+		return annotation.ColourName(c), nil
+	case string:
+		return c, nil
+	}
+	return "", fmt.Errorf("colour: expected a style number or colour name, got %T", v)
+}
+
+// truncate shortens s to at most n characters, ending it with an ellipsis
+// when it was cut.
+func truncate(n int, s string) string {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimRight(string(runes[:n-1]), " ") + "…"
+}
+
+// yamlValue encodes v as a single-line YAML value for frontmatter. Strings are
+// double-quoted with quotes, backslashes and line breaks escaped, and lists
+// and maps use flow style, so any title or author can follow a key.
+func yamlValue(v any) (string, error) {
+	var n yaml.Node
+	if err := n.Encode(v); err != nil {
+		return "", fmt.Errorf("yaml: %w", err)
+	}
+	if n.Kind != yaml.ScalarNode {
+		n.Style = yaml.FlowStyle
+	} else if n.Tag == "!!str" {
+		n.Style = yaml.DoubleQuotedStyle
+	}
+	b, err := yaml.Marshal(&n)
+	if err != nil {
+		return "", fmt.Errorf("yaml: %w", err)
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
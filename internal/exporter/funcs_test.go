@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestFuncs(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	created := time.Date(2024, 3, 31, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		tmpl string
+		data any
+		want string
+	}{
+		{`{{ date "2006-01-02 15:04" . }}`, created, "2024-04-01 01:30"},
+		{`{{ . | date "2006-01-02" }}`, time.Time{}, ""},
+		{`{{ dateIn "America/New_York" "2006-01-02 15:04" . }}`, created, "2024-03-31 19:30"},
+		{`{{ dateIn "UTC" "2006-01-02" . }}`, time.Time{}, ""},
+		{`{{ mdEscape . }}`, "*a* _b_ [c](d) #e |f| ~g~ ==h== <i> `j` \\", "\\*a\\* \\_b\\_ \\[c\\](d) \\#e \\|f\\| \\~g\\~ \\=\\=h\\=\\= \\<i\\> \\`j\\` \\\\"},
+		{`{{ wrap 10 . }}`, "one two three four", "one two\nthree four"},
+		{`{{ wrap 5 . }}`, "a extraordinary b", "a\nextraordinary\nb"},
+		{`{{ wrap 10 . }}`, "one two\nthree four five", "one two\nthree four\nfive"},
+		{`{{ truncate 5 . }}`, "short", "short"},
+		{`{{ truncate 5 . }}`, "longer text", "long…"},
+		{`{{ truncate 6 . }}`, "ab cd ef", "ab cd…"},
+		{`{{ truncate 4 . }}`, "ab cd", "ab…"},
+		{`{{ truncate 3 . }}`, "héllo", "hé…"},
+		{`{{ truncate 0 . }}`, "unchanged", "unchanged"},
+		{`{{ . | default "none" }}`, "", "none"},
+		{`{{ . | default "none" }}`, "set", "set"},
+		{`{{ . | default "none" }}`, 0, "none"},
+		{`{{ . | default "none" }}`, []string{}, "none"},
+		{`{{ . | default "none" }}`, nil, "none"},
+		{`{{ wikilink . }}`, "Dune", "[[Dune]]"},
+		{`{{ wikilink . "Frank Herbert's Dune" }}`, "Dune", "[[Dune|Frank Herbert's Dune]]"},
+		{`{{ wikilink . "Dune" }}`, "Dune", "[[Dune]]"},
+		{`{{ wikilink . "" }}`, "Dune", "[[Dune]]"},
+		{`{{ wikilink . }}`, "A [B] | C #1 ^2", "[[A -B- - C -1 -2]]"},
+		{`{{ join ", " . }}`, []string{"a", "b"}, "a, b"},
+		{`{{ join "/" . }}`, []int{1, 2, 3}, "1/2/3"},
+		{`{{ join ", " . }}`, []string{}, ""},
+		{`{{ colour . }}`, 3, "yellow"},
+		{`{{ colour . }}`, 0, "underline"},
+		{`{{ colour . }}`, 42, "unknown"},
+		{`{{ colour . }}`, "pink", "pink"},
+	}
+	for _, tt := range tests {
+		tpl := template.Must(template.New("").Funcs(funcMap(loc)).Parse(tt.tmpl))
+		var b strings.Builder
+		if err := tpl.Execute(&b, tt.data); err != nil {
+			t.Errorf("%s with %#v: %v", tt.tmpl, tt.data, err)
+			continue
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s with %#v = %q, want %q", tt.tmpl, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestFuncsErrors(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		data any
+	}{
+		{`{{ dateIn "Not/A_Zone" "2006" . }}`, time.Now()},
+		{`{{ join ", " . }}`, "not a list"},
+		{`{{ join ", " . }}`, 42},
+		{`{{ colour . }}`, 1.5},
+		{`{{ colour . }}`, []string{"pink"}},
+	}
+	for _, tt := range tests {
+		tpl := template.Must(template.New("").Funcs(funcMap(time.UTC)).Parse(tt.tmpl))
+		if err := tpl.Execute(new(strings.Builder), tt.data); err == nil {
+			t.Errorf("%s with %#v: no error", tt.tmpl, tt.data)
+		}
+	}
+}
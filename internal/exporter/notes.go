@@ -0,0 +1,293 @@
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gosimple/slug"
+	"gopkg.in/yaml.v3"
+)
+
+// NoteIndex remembers which note each book was exported to, keyed by asset
+// ID, and the hashes of the owned frontmatter values last written to it.
+// Paths are relative to the vault and slash-separated. *state.File
+// implements it.
+type NoteIndex interface {
+	NotePath(assetID string) string
+	SetNotePath(assetID, path string)
+	Frontmatter(assetID string) map[string]string
+	SetFrontmatter(assetID string, hashes map[string]string)
+}
+
+// memoryIndex is the NoteIndex used when none is configured.
+type memoryIndex map[string]memoryNote
+
+type memoryNote struct {
+	path        string
+	frontmatter map[string]string
+}
+
+func (m memoryIndex) NotePath(assetID string) string { return m[assetID].path }
+
+func (m memoryIndex) SetNotePath(assetID, path string) {
+	n := m[assetID]
+	n.path = path
+	m[assetID] = n
+}
+
+func (m memoryIndex) Frontmatter(assetID string) map[string]string { return m[assetID].frontmatter }
+
+func (m memoryIndex) SetFrontmatter(assetID string, hashes map[string]string) {
+	n := m[assetID]
+	n.frontmatter = hashes
+	m[assetID] = n
+}
+
+// noteFile is a note found in the vault and the asset ID in its frontmatter.
+type noteFile struct {
+	path    string
+	assetID string
+	// managed is set for notes without an asset ID that booksync wrote
+	// before notes were identified by it: those with a managed region or in
+	// legacyDir. Other notes without one belong to the user.
+	managed bool
+}
+
+// legacyDir is the folder booksync wrote every note to before note paths
+// were configurable.
+const legacyDir = "apple_books_sync"
+
+// noteKey folds a note path for comparison. The file systems notes usually
+// live on (APFS, exFAT, NTFS) are case-insensitive, so two paths differing
+// only in case name the same file.
+func noteKey(p string) string {
+	return strings.ToLower(p)
+}
+
+// readNote returns the asset_id in a note's frontmatter, or "" if it has
+// none, and whether the note has a managed region.
+func readNote(file string) (assetID string, managed bool, err error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", false, err
+	}
+	managed = bytes.Contains(b, []byte(RegionStart))
+	fm, _, ok := splitFrontmatter(b)
+	if !ok {
+		return "", managed, nil
+	}
+	m, err := parseMapping(fm)
+	if err != nil {
+		return "", managed, err
+	}
+	if i := mappingIndex(m, "asset_id"); i >= 0 {
+		return m.Content[i+1].Value, managed, nil
+	}
+	return "", managed, nil
+}
+
+// wholeNote reports whether a book's note without region markers was
+// written in full by booksync: it is in legacyDir, or its frontmatter
+// carries the book's asset ID.
+func wholeNote(note string, fm, body []byte, assetID string) bool {
+	if bytes.Contains(body, []byte(RegionStart)) || bytes.Contains(body, []byte(RegionEnd)) {
+		return false
+	}
+	if strings.HasPrefix(noteKey(note), legacyDir+"/") {
+		return true
+	}
+	m, err := parseMapping(fm)
+	if err != nil {
+		return false
+	}
+	i := mappingIndex(m, "asset_id")
+	return i >= 0 && m.Content[i+1].Value == assetID
+}
+
+// scanNotes records the asset ID of every note beneath the path template's
+// folder, so notes can be found by their frontmatter when the index doesn't
+// know them (after a state reset, or when they were moved by hand).
+func (e *Exporter) scanNotes() error {
+	e.owners = make(map[string]noteFile)
+	root := filepath.Join(e.vaultDir, filepath.FromSlash(e.scanDir))
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(p) != ".md" {
+			return nil
+		}
+		rel, err := filepath.Rel(e.vaultDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		assetID, managed, err := readNote(p)
+		if err != nil {
+			// Unreadable frontmatter: keep the note, but never claim it.
+			log.Printf("Warning: could not read frontmatter of %s: %v", p, err)
+			assetID, managed = "", false
+		}
+		managed = managed || strings.HasPrefix(noteKey(rel), legacyDir+"/")
+		e.owners[noteKey(rel)] = noteFile{path: rel, assetID: assetID, managed: managed}
+		return nil
+	})
+}
+
+// findNote returns the note whose frontmatter carries assetID, or "".
+func (e *Exporter) findNote(assetID string) string {
+	var found []string
+	for _, n := range e.owners {
+		if n.assetID == assetID {
+			found = append(found, n.path)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	sort.Strings(found)
+	return found[0]
+}
+
+// taken reports whether the note at p belongs to a different book, or to the
+// user. Notes booksync wrote before identifying them by asset_id are claimed
+// by the first book without a note of its own; other notes without one are
+// the user's and are never written to.
+func (e *Exporter) taken(p, assetID, current string) bool {
+	n, exists := e.owners[noteKey(p)]
+	if !exists {
+		return false
+	}
+	if n.assetID == "" {
+		return !n.managed || current != ""
+	}
+	return n.assetID != assetID
+}
+
+// disambiguate appends the asset ID to a note name, first shortened and then
+// in full, so a book whose name is already used by another book's note gets
+// a name of its own that doesn't change between syncs.
+func (e *Exporter) disambiguate(p, assetID, current string) string {
+	ext := path.Ext(p)
+	stem := strings.TrimSuffix(p, ext)
+	id := slug.Make(assetID)
+	short := id
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	for _, suffix := range []string{short, id} {
+		candidate := stem + "-" + suffix + ext
+		if !e.taken(candidate, assetID, current) {
+			return candidate
+		}
+	}
+	return stem + "-" + id + ext
+}
+
+// resolveNote returns the note a book is written to, relative to the vault.
+// Books are identified by asset ID: the note recorded in the index is used,
+// then one whose frontmatter has the book's asset ID. When the path template
+// renders a different path, because the title changed or the template did,
+// the note is moved there, unless another note already has that name.
+func (e *Exporter) resolveNote(bookData BookData) (string, error) {
+	if e.owners == nil {
+		if err := e.scanNotes(); err != nil {
+			return "", fmt.Errorf("failed to scan notes: %w", err)
+		}
+	}
+
+	current := e.index.NotePath(bookData.AssetID)
+	if current != "" {
+		if _, err := os.Stat(filepath.Join(e.vaultDir, filepath.FromSlash(current))); err != nil {
+			// The note was moved or deleted since it was last written.
+			if err := e.scanNotes(); err != nil {
+				return "", fmt.Errorf("failed to scan notes: %w", err)
+			}
+			current = ""
+		}
+	}
+	if current == "" {
+		current = e.findNote(bookData.AssetID)
+	}
+
+	want, err := e.notePath(bookData)
+	if err != nil {
+		return "", err
+	}
+	if noteKey(want) != noteKey(current) && e.taken(want, bookData.AssetID, current) {
+		want = e.disambiguate(want, bookData.AssetID, current)
+	}
+	if current == "" || current == want {
+		return want, nil
+	}
+
+	// A change of case alone renames the same file; any other move must not
+	// overwrite a note that already exists.
+	if noteKey(want) != noteKey(current) {
+		if _, exists := e.owners[noteKey(want)]; exists {
+			log.Printf("Warning: not moving %s to %s: the target already exists", current, want)
+			return current, nil
+		}
+	}
+	if err := e.moveNote(current, want); err != nil {
+		return "", err
+	}
+	delete(e.owners, noteKey(current))
+	e.owners[noteKey(want)] = noteFile{path: want, assetID: bookData.AssetID}
+	return want, nil
+}
+
+// moveNote renames a note within the vault and removes the folders it leaves
+// empty.
+func (e *Exporter) moveNote(from, to string) error {
+	src := filepath.Join(e.vaultDir, filepath.FromSlash(from))
+	dst := filepath.Join(e.vaultDir, filepath.FromSlash(to))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", to, err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move note %s to %s: %w", from, to, err)
+	}
+	log.Printf("Moved note %s to %s", from, to)
+
+	for dir := path.Dir(from); dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(e.vaultDir, filepath.FromSlash(dir))) != nil {
+			break // not empty
+		}
+	}
+	return nil
+}
+
+// withAssetID adds the asset_id key to rendered frontmatter that lacks it, so
+// every note can be identified even if its template doesn't emit one.
+func withAssetID(fm []byte, assetID string) ([]byte, error) {
+	m, err := parseMapping(fm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered frontmatter: %w", err)
+	}
+	if mappingIndex(m, "asset_id") >= 0 {
+		return fm, nil
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "asset_id"},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: assetID, Style: yaml.DoubleQuotedStyle},
+	)
+	return encodeMapping(m)
+}
@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteBookIdentifiesNotesByAssetID(t *testing.T) {
+	tpl := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(tpl, []byte("---\ntitle: {{ yaml .Title }}\n---\n{{ range .Highlights }}- {{ .Text }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vault := t.TempDir()
+	e, err := New(vault, tpl, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dune := BookData{AssetID: "A1", Title: "Dune", Highlights: []Highlight{{UUID: "H1", Text: "Fear is the mind-killer."}}}
+	other := BookData{AssetID: "B2C3D4E5F6", Title: "Dune", Highlights: []Highlight{{UUID: "H2", Text: "Another edition."}}}
+	note := func(name string) string {
+		return filepath.Join(vault, "apple_books_sync", name)
+	}
+
+	// Two books with the same title get notes of their own; the second one
+	// is named after its shortened asset ID.
+	for _, b := range []BookData{dune, other, dune} {
+		if err := e.WriteBook(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, note("dune.md")); !strings.Contains(got, `asset_id: "A1"`) || !strings.Contains(got, "Fear is the mind-killer.") {
+		t.Errorf("dune.md =\n%s", got)
+	}
+	if got := readFile(t, note("dune-b2c3d4e5.md")); !strings.Contains(got, `asset_id: "B2C3D4E5F6"`) || !strings.Contains(got, "Another edition.") {
+		t.Errorf("dune-b2c3d4e5.md =\n%s", got)
+	}
+
+	// A new title renames the note, keeping what was written by hand.
+	if err := os.WriteFile(note("dune.md"), []byte(readFile(t, note("dune.md"))+"\nMy own notes.\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dune.Title = "Dune Messiah"
+	if err := e.WriteBook(dune); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(note("dune.md")); !os.IsNotExist(err) {
+		t.Errorf("dune.md still exists after the rename: %v", err)
+	}
+	if got := readFile(t, note("dune-messiah.md")); !strings.Contains(got, `title: "Dune Messiah"`) || !strings.Contains(got, "My own notes.") {
+		t.Errorf("dune-messiah.md =\n%s", got)
+	}
+
+	// Without an index, notes are found by their frontmatter. The other
+	// edition takes the name Dune left free.
+	e, err = New(vault, tpl, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteBook(other); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(vault, "apple_books_sync"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got := strings.Join(names, " "); got != "dune-messiah.md dune.md" {
+		t.Errorf("notes = %s", got)
+	}
+	if got := readFile(t, note("dune.md")); !strings.Contains(got, `asset_id: "B2C3D4E5F6"`) {
+		t.Errorf("dune.md =\n%s", got)
+	}
+}
+
+func TestWriteBookMovesNotesWhenTheTemplateChanges(t *testing.T) {
+	tpl := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(tpl, []byte("{{ range .Highlights }}- {{ .Text }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vault := t.TempDir()
+	index := memoryIndex{}
+	book := BookData{AssetID: "A1", Title: "Dune: Messiah", Author: "Frank Herbert", Highlights: []Highlight{{UUID: "H1", Text: "Fear is the mind-killer."}}}
+
+	for _, tt := range []struct {
+		pathTpl string
+		want    string
+	}{
+		{"", "apple_books_sync/dune-messiah.md"},
+		{"Books/{{.Author}}/{{.Title}}.md", "Books/Frank Herbert/Dune- Messiah.md"},
+		{"Books/{{.Author}}/{{.Title}}.md", "Books/Frank Herbert/Dune- Messiah.md"},
+	} {
+		e, err := New(vault, tpl, Options{PathTemplate: tt.pathTpl, Index: index})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.WriteBook(book); err != nil {
+			t.Fatal(err)
+		}
+		if got := index.NotePath("A1"); got != tt.want {
+			t.Errorf("template %q: note = %s, want %s", tt.pathTpl, got, tt.want)
+		}
+		if got := readFile(t, filepath.Join(vault, filepath.FromSlash(tt.want))); !strings.Contains(got, "Fear is the mind-killer.") {
+			t.Errorf("%s =\n%s", tt.want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(vault, "apple_books_sync", "dune-messiah.md")); !os.IsNotExist(err) {
+		t.Errorf("the old note was not moved: %v", err)
+	}
+}
+
+func TestWriteBookClaimsOnlyBooksyncNotes(t *testing.T) {
+	const handWritten = "# Dune\n\nMy own notes.\n"
+	book := BookData{AssetID: "ASSET-1", Title: "Dune", Author: "Frank Herbert", Highlights: []Highlight{{UUID: "H1", Text: "Fear is the mind-killer."}}}
+
+	tests := []struct {
+		name      string
+		pathTpl   string
+		existing  string // note already in the vault
+		content   string
+		wantNote  string // where the book is written
+		untouched bool   // whether existing must be left as it was
+	}{
+		{
+			name:      "hand-written note in the template's folder",
+			pathTpl:   "Books/{{.Author}}/{{.Title}}.md",
+			existing:  "Books/Frank Herbert/Dune.md",
+			content:   handWritten,
+			wantNote:  "Books/Frank Herbert/Dune-asset-1.md",
+			untouched: true,
+		},
+		{
+			name:      "hand-written note when the template starts with an action",
+			pathTpl:   "{{.Title}}.md",
+			existing:  "Dune.md",
+			content:   handWritten,
+			wantNote:  "Dune-asset-1.md",
+			untouched: true,
+		},
+		{
+			name:     "legacy note in apple_books_sync",
+			existing: "apple_books_sync/dune.md",
+			content:  "---\ntitle: \"Dune\"\n---\n- Fear is the mind-killer.\n",
+			wantNote: "apple_books_sync/dune.md",
+		},
+		{
+			name:     "note with the asset ID but no markers",
+			pathTpl:  "Books/{{.Title}}.md",
+			existing: "Books/Dune.md",
+			content:  "---\nasset_id: \"ASSET-1\"\n---\n- Fear is the mind-killer.\n",
+			wantNote: "Books/Dune.md",
+		},
+		{
+			name:     "note with a managed region",
+			pathTpl:  "Books/{{.Title}}.md",
+			existing: "Books/Dune.md",
+			content:  "# Dune\n\n" + RegionStart + "\n- old\n" + RegionEnd + "\n",
+			wantNote: "Books/Dune.md",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vault := t.TempDir()
+			existing := filepath.Join(vault, filepath.FromSlash(tt.existing))
+			if err := os.MkdirAll(filepath.Dir(existing), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(existing, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := New(vault, "obsidian", Options{PathTemplate: tt.pathTpl})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := e.WriteBook(book); err != nil {
+				t.Fatal(err)
+			}
+
+			note := readFile(t, filepath.Join(vault, filepath.FromSlash(tt.wantNote)))
+			if !strings.Contains(note, `asset_id: "ASSET-1"`) || strings.Count(note, "Fear is the mind-killer.") != 1 {
+				t.Errorf("book not written to %s exactly once:\n%s", tt.wantNote, note)
+			}
+			if got := readFile(t, existing); tt.untouched && got != tt.content {
+				t.Errorf("%s was modified:\n%s", tt.existing, got)
+			}
+		})
+	}
+}
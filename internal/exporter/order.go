@@ -0,0 +1,82 @@
+package exporter
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/naimoon6450/booksync/internal/cfi"
+)
+
+func compareCreated(a, b Highlight) int {
+	return a.Created.Compare(b.Created)
+}
+
+// sortHighlights returns highlights sorted by order. Ties, and highlights
+// whose position is unknown, fall back to the time they were made, which
+// keeps the order stable between syncs.
+func sortHighlights(highlights []Highlight, order string) []Highlight {
+	if len(highlights) < 2 {
+		return highlights
+	}
+	if order == OrderPosition {
+		return sortByPosition(highlights)
+	}
+
+	sorted := slices.Clone(highlights)
+	slices.SortStableFunc(sorted, func(a, b Highlight) int {
+		if order == OrderModified {
+			if c := a.Modified.Compare(b.Modified); c != 0 {
+				return c
+			}
+		}
+		return compareCreated(a, b)
+	})
+	return sorted
+}
+
+// sortByPosition orders highlights by where they are in the book. Those
+// with a CFI are put in document order. Those with only a range start are
+// merged in by comparing range starts with the CFI highlights that have one
+// too: each goes before the first of them that starts later. A CFI and a
+// range start can't be compared directly, so the merge never reorders the
+// CFI highlights among themselves. Highlights with neither come last.
+func sortByPosition(highlights []Highlight) []Highlight {
+	type located struct {
+		h   Highlight
+		cfi cfi.CFI
+	}
+	var withCFI []located
+	var withStart, unknown []Highlight
+	for _, h := range highlights {
+		if h.Location != "" {
+			if c, err := cfi.Parse(h.Location); err == nil {
+				withCFI = append(withCFI, located{h: h, cfi: c})
+				continue
+			}
+		}
+		if h.LocationStart > 0 {
+			withStart = append(withStart, h)
+		} else {
+			unknown = append(unknown, h)
+		}
+	}
+
+	slices.SortStableFunc(withCFI, func(a, b located) int {
+		return cmp.Or(cfi.Compare(a.cfi, b.cfi), compareCreated(a.h, b.h))
+	})
+	slices.SortStableFunc(withStart, func(a, b Highlight) int {
+		return cmp.Or(cmp.Compare(a.LocationStart, b.LocationStart), compareCreated(a, b))
+	})
+	slices.SortStableFunc(unknown, compareCreated)
+
+	sorted := make([]Highlight, 0, len(highlights))
+	for _, l := range withCFI {
+		for len(withStart) > 0 && l.h.LocationStart > 0 && withStart[0].LocationStart < l.h.LocationStart {
+			sorted = append(sorted, withStart[0])
+			withStart = withStart[1:]
+		}
+		sorted = append(sorted, l.h)
+	}
+	sorted = append(sorted, withStart...)
+	return append(sorted, unknown...)
+}
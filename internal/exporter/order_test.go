@@ -0,0 +1,41 @@
+package exporter
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSortHighlights(t *testing.T) {
+	day := func(n int) time.Time { return time.Date(2024, 1, n, 0, 0, 0, 0, time.UTC) }
+	highlights := []Highlight{
+		{UUID: "unknown", Created: day(1)},
+		{UUID: "ch3", Location: "epubcfi(/6/8!/4/2/1:0)", LocationStart: 300, Created: day(2)},
+		{UUID: "start-250", LocationStart: 250, Created: day(3)},
+		{UUID: "ch1", Location: "epubcfi(/6/4!/4/2,/1:0,/1:9)", LocationStart: 100, Created: day(4), Modified: day(9)},
+		{UUID: "start-50", LocationStart: 50, Created: day(5)},
+		{UUID: "ch2-no-start", Location: "epubcfi(/6/6!/4/2/1:0)", Created: day(6)},
+		{UUID: "bad-cfi", Location: "epubcfi(/6/4!", LocationStart: 400, Created: day(7)},
+		{UUID: "ch1-again", Location: "epubcfi(/6/4!/4/2/1:20)", Created: day(8)},
+	}
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		// Range starts are merged in among the CFIs that have one, without
+		// breaking up the CFI order; ties fall back to creation time.
+		{OrderPosition, []string{"start-50", "ch1", "ch1-again", "ch2-no-start", "start-250", "ch3", "bad-cfi", "unknown"}},
+		{OrderCreated, []string{"unknown", "ch3", "start-250", "ch1", "start-50", "ch2-no-start", "bad-cfi", "ch1-again"}},
+		{OrderModified, []string{"unknown", "ch3", "start-250", "start-50", "ch2-no-start", "bad-cfi", "ch1-again", "ch1"}},
+	}
+	for _, tt := range tests {
+		sorted := sortHighlights(slices.Clone(highlights), tt.order)
+		var got []string
+		for _, h := range sorted {
+			got = append(got, h.UUID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("order %s:\n got %v\nwant %v", tt.order, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/gosimple/slug"
+)
+
+// DefaultPathTemplate reproduces the original layout: every note in
+// apple_books_sync, named after the slug of its title, with books missing
+// from the library in a folder of their own.
+const DefaultPathTemplate = legacyDir + "/{{if .Unknown}}" + UnknownBooksDir + "/{{end}}{{.Slug}}.md"
+
+// UnknownBooksDir is the folder, inside apple_books_sync, holding the notes of
+// books missing from the Apple Books library with the default path template.
+const UnknownBooksDir = "Unknown books"
+
+// maxNameBytes caps the length of each path segment. File systems allow 255
+// bytes (APFS, ext4) or 255 UTF-16 units (exFAT, NTFS); the margin leaves room
+// for the suffix added to disambiguate books that share a name.
+const maxNameBytes = 200
+
+// PathData is the data available to the path template.
+type PathData struct {
+	Title   string
+	Author  string
+	AssetID string
+	// Slug is the title lowercased with everything but letters and digits
+	// replaced by dashes.
+	Slug string
+	// Year is the year of the book's earliest highlight, or 0 if it has none.
+	Year int
+	// Unknown is set for books missing from the Apple Books library.
+	Unknown bool
+}
+
+// parsePathTemplate parses a note path template and checks that it renders
+// for a sample book.
+func parsePathTemplate(text string, funcs template.FuncMap) (*template.Template, error) {
+	if text == "" {
+		text = DefaultPathTemplate
+	}
+	t, err := template.New("path").Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse path template: %w", err)
+	}
+	sample := PathData{Title: "Sample", Author: "Author", AssetID: "SAMPLE", Slug: "sample", Year: 2024}
+	if err := t.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, fmt.Errorf("failed to execute path template: %w", err)
+	}
+	return t, nil
+}
+
+// pathData returns the path template data for a book. Path separators in
+// titles and authors are replaced so they can't create folders; only the
+// template itself can.
+func pathData(bookData BookData) PathData {
+	noSep := strings.NewReplacer("/", "-", `\`, "-")
+	d := PathData{
+		Title:   noSep.Replace(bookData.Title),
+		Author:  noSep.Replace(bookData.Author),
+		AssetID: noSep.Replace(bookData.AssetID),
+		Slug:    slug.Make(bookData.Title),
+		Unknown: bookData.UnknownBook,
+	}
+	for _, h := range bookData.Highlights {
+		if h.Created.IsZero() {
+			continue
+		}
+		if y := h.Created.Year(); d.Year == 0 || y < d.Year {
+			d.Year = y
+		}
+	}
+	return d
+}
+
+// notePath renders the path of a book's note, relative to the vault and
+// slash-separated, before collisions with other books are resolved.
+func (e *Exporter) notePath(bookData BookData) (string, error) {
+	var b bytes.Buffer
+	if err := e.pathTpl.Execute(&b, pathData(bookData)); err != nil {
+		return "", fmt.Errorf("failed to execute path template for book %s: %w", bookData.Title, err)
+	}
+	return sanitizePath(b.String()), nil
+}
+
+// sanitizePath makes a rendered path safe to use on macOS, Windows and Linux
+// file systems: every segment is cleaned, empty and dot segments are dropped
+// so the path can't leave the vault, and the file gets a .md extension.
+func sanitizePath(p string) string {
+	var segments []string
+	for _, seg := range strings.Split(strings.ReplaceAll(p, `\`, "/"), "/") {
+		seg = strings.TrimSpace(seg)
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	if len(segments) == 0 {
+		segments = []string{"untitled.md"}
+	}
+
+	last := len(segments) - 1
+	name := strings.TrimSuffix(segments[last], ".md")
+	for i, seg := range segments[:last] {
+		segments[i] = sanitizeName(seg)
+	}
+	segments[last] = sanitizeName(name) + ".md"
+	return path.Join(segments...)
+}
+
+// windowsReserved lists names Windows refuses for files and folders,
+// whatever their extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeName cleans a single file or folder name: reserved characters
+// become dashes and control characters are dropped, leading dots (hidden
+// files) and trailing dots and spaces are trimmed, reserved device names are
+// prefixed, and the name is cut to maxNameBytes on a character boundary.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			return '-'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(name, ". ")
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		name = "untitled"
+	}
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(stem)] {
+		name = "_" + name
+	}
+	if len(name) > maxNameBytes {
+		cut := maxNameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = strings.TrimRight(name[:cut], ". ")
+	}
+	return name
+}
+
+// staticDir returns the folder a path template always writes beneath: the
+// directory part of the text before its first action.
+func staticDir(text string) string {
+	if text == "" {
+		text = DefaultPathTemplate
+	}
+	prefix, _, _ := strings.Cut(text, "{{")
+	i := strings.LastIndex(prefix, "/")
+	if i < 0 {
+		return ""
+	}
+	var segments []string
+	for _, seg := range strings.Split(prefix[:i], "/") {
+		seg = strings.TrimSpace(seg)
+		if seg == "" || seg == "." || seg == ".." {
+			continue
+		}
+		segments = append(segments, sanitizeName(seg))
+	}
+	return path.Join(segments...)
+}
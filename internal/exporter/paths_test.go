@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Dune", "Dune"},
+		{`What? A <Title>: "Part" 1/2\3|4*`, "What- A -Title-- -Part- 1-2-3-4-"},
+		{"Tab\there\x7f", "Tabhere"},
+		{".hidden", "hidden"},
+		{"  ..Name.. ", "Name"},
+		{"...", "untitled"},
+		{"", "untitled"},
+		// Reserved device names are refused with any extension and in any
+		// case, but only as the whole stem.
+		{"CON", "_CON"},
+		{"con", "_con"},
+		{"nul.md", "_nul.md"},
+		{"Com1.tar.gz", "_Com1.tar.gz"},
+		{"LPT9", "_LPT9"},
+		{"CONSOLE", "CONSOLE"},
+		{"COM0", "COM0"},
+		{"LPT10", "LPT10"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeName(tt.in); got != tt.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNameTruncates(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"ascii", strings.Repeat("a", 300), strings.Repeat("a", maxNameBytes)},
+		// 3-byte runes: 66 fit in 198 bytes; the 67th would end at 201.
+		{"cjk", strings.Repeat("本", 100), strings.Repeat("本", 66)},
+		// A 4-byte rune straddling the limit is dropped whole.
+		{"emoji", strings.Repeat("a", 198) + "📚📚", strings.Repeat("a", 198)},
+		{"trailing dots after the cut", strings.Repeat("a", 190) + strings.Repeat(". ", 20), strings.Repeat("a", 190)},
+		{"exactly the limit", strings.Repeat("é", maxNameBytes/2), strings.Repeat("é", maxNameBytes/2)},
+	}
+	for _, tt := range tests {
+		got := sanitizeName(tt.in)
+		if got != tt.want {
+			t.Errorf("%s: sanitizeName = %q (%d bytes), want %q (%d bytes)", tt.name, got, len(got), tt.want, len(tt.want))
+		}
+		if len(got) > maxNameBytes || !utf8.ValidString(got) {
+			t.Errorf("%s: %q is %d bytes or invalid UTF-8", tt.name, got, len(got))
+		}
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"apple_books_sync/dune.md", "apple_books_sync/dune.md"},
+		{"apple_books_sync/dune", "apple_books_sync/dune.md"},
+		{`Books\Herbert\Dune.md`, "Books/Herbert/Dune.md"},
+		{"/abs//path/./x.md", "abs/path/x.md"},
+		{"../../etc/passwd", "etc/passwd.md"},
+		{"a/../b.md", "a/b.md"},
+		{" Books / Dune .md", "Books/Dune.md"},
+		{"", "untitled.md"},
+		{"../..", "untitled.md"},
+		{"books/.md", "books/untitled.md"},
+		{"CON/aux.md", "_CON/_aux.md"},
+		{"Books/What? Now.md", "Books/What- Now.md"},
+		{"Books/" + strings.Repeat("x", 250) + ".md", "Books/" + strings.Repeat("x", maxNameBytes) + ".md"},
+	}
+	for _, tt := range tests {
+		if got := sanitizePath(tt.in); got != tt.want {
+			t.Errorf("sanitizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStaticDir(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "apple_books_sync"},
+		{DefaultPathTemplate, "apple_books_sync"},
+		{"{{.Slug}}.md", ""},
+		{"Books/{{.Author}}/{{.Slug}}.md", "Books"},
+		{"Books/Kindle/{{.Slug}}.md", "Books/Kindle"},
+		{"Books/By {{.Author}}/{{.Slug}}.md", "Books"},
+		{"./Books/../Notes/{{.Slug}}.md", "Books/Notes"},
+		{"Books: Read/{{.Slug}}.md", "Books- Read"},
+		{"Books/notes.md", "Books"},
+	}
+	for _, tt := range tests {
+		if got := staticDir(tt.in); got != tt.want {
+			t.Errorf("staticDir(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultPathTemplate(t *testing.T) {
+	e, err := New(t.TempDir(), "obsidian", Options{SkipCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		book BookData
+		want string
+	}{
+		{BookData{AssetID: "A1", Title: "Dune: Messiah"}, "apple_books_sync/dune-messiah.md"},
+		{BookData{AssetID: "9F2C6A8E", Title: "9F2C6A8E", UnknownBook: true}, "apple_books_sync/" + UnknownBooksDir + "/9f2c6a8e.md"},
+	} {
+		if got, err := e.notePath(tt.book); err != nil || got != tt.want {
+			t.Errorf("notePath(%s) = %q, %v; want %q", tt.book.Title, got, err, tt.want)
+		}
+	}
+}
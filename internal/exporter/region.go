@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Markers delimiting the part of a book note that booksync owns. Everything
+// outside of them belongs to the user and is never modified.
+const (
+	RegionStart = "<!-- booksync:start -->"
+	RegionEnd   = "<!-- booksync:end -->"
+)
+
+// ErrCorruptRegion is returned when an existing note contains a managed region
+// whose markers are missing, duplicated or out of order. The note is left
+// untouched so that no hand-written content is lost.
+var ErrCorruptRegion = errors.New("corrupt booksync region markers")
+
+// buildRegion wraps rendered content in the managed region markers.
+func buildRegion(content []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(RegionStart)
+	b.WriteByte('\n')
+	b.Write(content)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	b.WriteString(RegionEnd)
+	return b.Bytes()
+}
+
+// mergeRegion replaces the managed region of an existing note with content.
+// A note without any markers gets the region appended at its end, so the first
+// write to a new (or hand-made) note creates the region.
+func mergeRegion(existing, content []byte) ([]byte, error) {
+	region := buildRegion(content)
+
+	startCount := bytes.Count(existing, []byte(RegionStart))
+	endCount := bytes.Count(existing, []byte(RegionEnd))
+
+	if startCount == 0 && endCount == 0 {
+		var b bytes.Buffer
+		b.Write(existing)
+		if len(existing) > 0 {
+			if existing[len(existing)-1] != '\n' {
+				b.WriteByte('\n')
+			}
+			b.WriteByte('\n')
+		}
+		b.Write(region)
+		b.WriteByte('\n')
+		return b.Bytes(), nil
+	}
+
+	if startCount != 1 || endCount != 1 {
+		return nil, fmt.Errorf("%w: found %d start and %d end marker(s)", ErrCorruptRegion, startCount, endCount)
+	}
+
+	start := bytes.Index(existing, []byte(RegionStart))
+	end := bytes.Index(existing, []byte(RegionEnd))
+	if end < start {
+		return nil, fmt.Errorf("%w: end marker precedes start marker", ErrCorruptRegion)
+	}
+
+	var b bytes.Buffer
+	b.Write(existing[:start])
+	b.Write(region)
+	b.Write(existing[end+len(RegionEnd):])
+	return b.Bytes(), nil
+}
@@ -0,0 +1,60 @@
+package exporter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergeRegion(t *testing.T) {
+	const region = RegionStart + "\nnew\n" + RegionEnd
+	tests := []struct {
+		name     string
+		existing string
+		want     string
+	}{
+		{"new note", "", region + "\n"},
+		{"hand-made note", "# Dune\nMy notes", "# Dune\nMy notes\n\n" + region + "\n"},
+		{"hand-made note ending in a newline", "# Dune\n", "# Dune\n\n" + region + "\n"},
+		{
+			"region replaced",
+			"before\n" + RegionStart + "\nold\nlines\n" + RegionEnd + "\nafter\n",
+			"before\n" + region + "\nafter\n",
+		},
+		{
+			"text around the markers kept",
+			"a" + RegionStart + "old" + RegionEnd + "b",
+			"a" + region + "b",
+		},
+		{"empty region", RegionStart + RegionEnd, region},
+	}
+	for _, tt := range tests {
+		got, err := mergeRegion([]byte(tt.existing), []byte("new"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeRegionCorrupt(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+	}{
+		{"start only", "notes\n" + RegionStart + "\nold\n"},
+		{"end only", "old\n" + RegionEnd + "\nnotes\n"},
+		{"duplicated start", RegionStart + "\n" + RegionStart + "\nold\n" + RegionEnd},
+		{"duplicated end", RegionStart + "\nold\n" + RegionEnd + "\n" + RegionEnd},
+		{"two regions", RegionStart + "a" + RegionEnd + "\n" + RegionStart + "b" + RegionEnd},
+		{"reversed", RegionEnd + "\nnotes\n" + RegionStart},
+	}
+	for _, tt := range tests {
+		got, err := mergeRegion([]byte(tt.existing), []byte("new"))
+		if !errors.Is(err, ErrCorruptRegion) {
+			t.Errorf("%s: got %q, %v; want ErrCorruptRegion", tt.name, got, err)
+		}
+	}
+}
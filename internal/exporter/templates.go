@@ -0,0 +1,161 @@
+package exporter
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultTemplate is the built-in template used when none is configured.
+const DefaultTemplate = "obsidian"
+
+//go:embed templates/*.tmpl
+var builtinFS embed.FS
+
+// Builtins returns the names of the built-in templates.
+func Builtins() []string {
+	entries, _ := fs.ReadDir(builtinFS, "templates")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".tmpl"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Partials are the blocks of a page template that can be overridden on their
+// own. The highlight partial is executed with a single Highlight; the others
+// with the BookData.
+var Partials = []string{"header", "highlight", "footer"}
+
+// pageTemplate is the name of the template rendering a whole note.
+const pageTemplate = "page"
+
+// loadTemplate builds the template set for a note template and returns its
+// page template, along with where each template in the set was read from.
+//
+// spec is either the path of a template file or directory, or the name of a
+// template. A name is looked up in dir by convention: <name>.tmpl replaces
+// the page template, and a <name> folder may hold page.tmpl and any of the
+// Partials (header.tmpl, highlight.tmpl, footer.tmpl), each overriding only
+// that part. Whatever isn't overridden is inherited from the built-in
+// template of the same name, or from DefaultTemplate. An empty spec selects
+// DefaultTemplate.
+func loadTemplate(spec, dir string, funcs template.FuncMap) (*template.Template, map[string]string, error) {
+	if spec == "" {
+		spec = DefaultTemplate
+	}
+
+	var files []string // page first, then partials
+	base := spec
+	if isTemplatePath(spec) {
+		info, err := os.Stat(spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read template %s: %w", spec, err)
+		}
+		base = DefaultTemplate
+		if info.IsDir() {
+			files = setFiles(spec)
+		} else {
+			files = []string{spec}
+		}
+	} else if dir != "" {
+		if p := filepath.Join(dir, spec+".tmpl"); fileExists(p) {
+			files = append(files, p)
+		}
+		files = append(files, setFiles(filepath.Join(dir, spec))...)
+	}
+
+	builtin, err := builtinFS.ReadFile("templates/" + base + ".tmpl")
+	if err != nil {
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("unknown template %q (built-in templates: %s)", spec, strings.Join(Builtins(), ", "))
+		}
+		base = DefaultTemplate
+		builtin, _ = builtinFS.ReadFile("templates/" + base + ".tmpl")
+	}
+	t, err := template.New(pageTemplate).Funcs(funcs).Parse(string(builtin))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse built-in template %s: %w", base, err)
+	}
+	sources := make(map[string]string)
+	for _, d := range t.Templates() {
+		sources[d.Name()] = "built-in " + base
+	}
+
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read template file %s: %w", f, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(f), ".tmpl")
+		if !slices.Contains(Partials, name) {
+			name = pageTemplate
+		} else {
+			// Partials are spliced into the page; the newline editors add at
+			// the end of a file is not part of them.
+			b = bytes.TrimSuffix(b, []byte("\n"))
+		}
+		if _, err := t.New(name).Parse(string(b)); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse template %s: %w", f, err)
+		}
+		sources[name] = f
+	}
+	return t.Lookup(pageTemplate), sources, nil
+}
+
+// setFiles returns the template files in a template set folder: page.tmpl
+// followed by the partials, skipping those that don't exist.
+func setFiles(dir string) []string {
+	var files []string
+	for _, name := range append([]string{pageTemplate}, Partials...) {
+		if p := filepath.Join(dir, name+".tmpl"); fileExists(p) {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+func fileExists(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && !info.IsDir()
+}
+
+// isTemplatePath reports whether a template spec names a file rather than a
+// template: it has a directory or an extension, or a file by that name exists.
+func isTemplatePath(spec string) bool {
+	if strings.ContainsAny(spec, `/\`) || filepath.Ext(spec) != "" {
+		return true
+	}
+	_, err := os.Stat(spec)
+	return err == nil
+}
+
+// SampleBook returns a book exercising every field templates can use: a
+// highlight with a note, an underline, a deleted highlight and an archived
+// one.
+func SampleBook() BookData {
+	created := time.Date(2024, 3, 14, 9, 26, 53, 0, time.UTC)
+	return BookData{
+		AssetID: "SAMPLE-ASSET",
+		Title:   "Sample Book",
+		Author:  "Sample Author",
+		Highlights: []Highlight{
+			{UUID: "SAMPLE-1", AssetID: "SAMPLE-ASSET", Text: "A highlighted passage.", Note: "A note on it.", Style: 3, Colour: "yellow", Created: created, Modified: created, Location: "epubcfi(/6/4[chap01]!/4/2/1:0)"},
+			{UUID: "SAMPLE-2", AssetID: "SAMPLE-ASSET", Text: "An underlined passage.", Style: 0, Colour: "underline", Underline: true, Created: created, Modified: created},
+			{UUID: "SAMPLE-3", AssetID: "SAMPLE-ASSET", Text: "A deleted passage.", Deleted: true, DeletedAt: created},
+		},
+		Archived: []Highlight{
+			{UUID: "SAMPLE-4", AssetID: "SAMPLE-ASSET", Text: "An archived passage.", Note: "Its note.", Deleted: true, DeletedAt: created},
+		},
+		LastSynced: created,
+	}
+}
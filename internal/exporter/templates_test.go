@@ -0,0 +1,263 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// render loads a template as New does and renders SampleBook with it.
+func render(t *testing.T, spec, dir string) (string, map[string]string, error) {
+	t.Helper()
+	tpl, sources, err := loadTemplate(spec, dir, funcMap(time.UTC))
+	if err != nil {
+		return "", nil, err
+	}
+	var b strings.Builder
+	if err := tpl.Execute(&b, SampleBook()); err != nil {
+		t.Fatalf("%s: %v", spec, err)
+	}
+	return b.String(), sources, nil
+}
+
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, text := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplates(t, dir, map[string]string{
+		// A page replacing the built-in logseq page.
+		"logseq.tmpl": "my logseq: {{ .Title }}",
+		// Partials overriding only part of the built-in obsidian page.
+		"obsidian/highlight.tmpl": ">> {{ .Text }}\n",
+		"obsidian/footer.tmpl":    "The end.",
+		// A set of its own, inheriting the partials it doesn't define from
+		// the default template.
+		"mine/page.tmpl":      "{{ block \"header\" . }}{{ end }}|{{ range .Highlights }}{{ block \"highlight\" . }}{{ end }};{{ end }}",
+		"mine/highlight.tmpl": "{{ .UUID }}",
+	})
+
+	tests := []struct {
+		spec, dir   string
+		wantSources map[string]string
+		want        []string
+		notWant     []string
+	}{
+		{"", "", map[string]string{"page": "built-in obsidian", "highlight": "built-in obsidian"}, []string{"# Sample Book", "- A highlighted passage."}, nil},
+		{"markdown", dir, map[string]string{"page": "built-in markdown"}, []string{"Sample Book"}, nil},
+		{"logseq", dir, map[string]string{"page": filepath.Join(dir, "logseq.tmpl")}, []string{"my logseq: Sample Book"}, nil},
+		{
+			"obsidian", dir,
+			map[string]string{"page": "built-in obsidian", "highlight": filepath.Join(dir, "obsidian", "highlight.tmpl"), "footer": filepath.Join(dir, "obsidian", "footer.tmpl")},
+			[]string{"# Sample Book", ">> A highlighted passage.", "The end."}, []string{"- A highlighted passage."},
+		},
+		{
+			filepath.Join(dir, "mine"), "",
+			map[string]string{"page": filepath.Join(dir, "mine", "page.tmpl"), "header": "built-in obsidian", "highlight": filepath.Join(dir, "mine", "highlight.tmpl")},
+			[]string{"# Sample Book", "|SAMPLE-1;SAMPLE-2;"}, nil,
+		},
+	}
+	for _, tt := range tests {
+		got, sources, err := render(t, tt.spec, tt.dir)
+		if err != nil {
+			t.Errorf("loadTemplate(%q, %q): %v", tt.spec, tt.dir, err)
+			continue
+		}
+		for name, want := range tt.wantSources {
+			if sources[name] != want {
+				t.Errorf("loadTemplate(%q, %q) read %s from %s, want %s", tt.spec, tt.dir, name, sources[name], want)
+			}
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: note doesn't contain %q:\n%s", tt.spec, w, got)
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(got, w) {
+				t.Errorf("%s: note contains %q:\n%s", tt.spec, w, got)
+			}
+		}
+	}
+
+	for _, spec := range []string{"no-such-template", filepath.Join(dir, "missing.tmpl")} {
+		if _, _, err := loadTemplate(spec, dir, funcMap(time.UTC)); err == nil {
+			t.Errorf("loadTemplate(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestBuiltinsRenderSampleBook(t *testing.T) {
+	names := Builtins()
+	if strings.Join(names, " ") != "logseq markdown obsidian" {
+		t.Errorf("Builtins() = %v", names)
+	}
+	for _, name := range append(names, "../../templates/note.tmpl", "../../templates/default.md.tmpl") {
+		vault := t.TempDir()
+		e, err := New(vault, name, Options{})
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := e.WriteBook(SampleBook()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestNewChecksTemplate(t *testing.T) {
+	tpl := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(tpl, []byte("# {{ .BookTitle }}\n{{ range .Highlights }}- {{ .Text }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(t.TempDir(), tpl, Options{})
+	if err == nil || !strings.Contains(err.Error(), "BookTitle") {
+		t.Errorf("New with a missing field returned %v", err)
+	}
+}
+
+func TestBuiltinsQuoteFrontmatter(t *testing.T) {
+	book := SampleBook()
+	book.Title = `He said "hi": a\b #1`
+	book.Author = "O'Brien: 'Jr.'"
+	for _, name := range Builtins() {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(t.TempDir(), name, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			note, err := e.Render(book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fm, _, ok := splitFrontmatter(note)
+			if !ok {
+				t.Fatalf("no frontmatter in\n%s", note)
+			}
+			var got map[string]any
+			if err := yaml.Unmarshal(fm, &got); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"title": book.Title, "author": book.Author, "asset_id": book.AssetID}
+			for k, v := range want {
+				if g, ok := got[k]; ok && g != v {
+					t.Errorf("%s = %q, want %q", k, g, v)
+				}
+			}
+		})
+	}
+}
+
+func TestBuiltinsIndentMultilineText(t *testing.T) {
+	book := SampleBook()
+	book.Highlights = []Highlight{{
+		UUID:    "H1",
+		AssetID: book.AssetID,
+		Text:    "First paragraph.\n\nSecond paragraph,\nwrapped.",
+		Note:    "A note\nover two lines.",
+	}}
+	tests := map[string][]string{
+		"obsidian": {"- First paragraph.\n\n  Second paragraph,\n  wrapped. [↗](", "^bs-", "  - Note: A note\n    over two lines.\n"},
+		"logseq":   {"- First paragraph.\n\n  Second paragraph,\n  wrapped. [↗](", "\t- A note\n\t  over two lines."},
+		"markdown": {"> First paragraph.\n>\n> Second paragraph,\n> wrapped. [↗]("},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(t.TempDir(), name, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			note, err := e.Render(book)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range want {
+				if !strings.Contains(string(note), w) {
+					t.Errorf("note doesn't contain %q:\n%s", w, note)
+				}
+			}
+		})
+	}
+}
+
+func TestIndentRest(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"one line", "one line"},
+		{"a\nb", "a\n  b"},
+		{"a\n\nb\n", "a\n\n  b\n"},
+		{"\nb", "\n  b"},
+	}
+	for _, tt := range tests {
+		if got := indentRest("  ", tt.in); got != tt.want {
+			t.Errorf("indentRest(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestYAMLValue(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{"plain", `"plain"`},
+		{`He said "hi": a\b`, `"He said \"hi\": a\\b"`},
+		{"two\nlines", `"two\nlines"`},
+		{"", `""`},
+		{42, "42"},
+		{true, "true"},
+		{[]string{"a", "b c"}, "[a, b c]"},
+	}
+	for _, tt := range tests {
+		got, err := yamlValue(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("yamlValue(%#v) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestObsidianBlockIDCoversHighlight checks that the block ID of a
+// multi-line highlight ends the list item holding all of its text, so that
+// embedding it embeds the whole highlight rather than its last paragraph.
+func TestObsidianBlockIDCoversHighlight(t *testing.T) {
+	book := SampleBook()
+	h := Highlight{UUID: "H1", AssetID: book.AssetID, Text: "First paragraph.\n\nSecond paragraph,\nwrapped."}
+	book.Highlights = []Highlight{h}
+
+	e, err := New(t.TempDir(), "obsidian", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, err := e.Render(book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := splitFrontmatter(note)
+	start := strings.Index(string(body), "- First paragraph.")
+	end := strings.Index(string(body), "^"+h.BlockID())
+	if start < 0 || end < start {
+		t.Fatalf("highlight or block ID missing:\n%s", body)
+	}
+	for _, line := range strings.Split(string(body[start:end]), "\n")[1:] {
+		if line != "" && !strings.HasPrefix(line, "  ") {
+			t.Errorf("line %q ends the list item before the block ID:\n%s", line, body)
+		}
+	}
+}
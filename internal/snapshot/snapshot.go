@@ -0,0 +1,252 @@
+// Package snapshot keeps private, consistent copies of the Apple Books
+// databases. A snapshot is only refreshed when the live database or its
+// write-ahead log changed, and is always replaced atomically.
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// sidecars are the files that make up a database's content in WAL mode.
+// Recent writes live in the -wal file until Apple Books checkpoints it. The
+// -shm index is left out, as SQLite touches it on every read, ours included.
+var sidecars = []string{"", "-wal"}
+
+// Source pairs a live database with the path of its snapshot.
+type Source struct {
+	Path string // live database, e.g. inside the Apple Books container
+	Dest string // private snapshot read by booksync
+}
+
+// fileInfo describes one file of a live database for change detection.
+type fileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Manager refreshes snapshots of one or more sources.
+type Manager struct {
+	mu      sync.Mutex
+	sources []Source
+}
+
+func New(sources ...Source) *Manager {
+	return &Manager{sources: sources}
+}
+
+// Sources returns the sources managed by m.
+func (m *Manager) Sources() []Source {
+	return m.sources
+}
+
+// Refresh re-snapshots every source whose database or WAL file changed since
+// its snapshot was taken. It reports whether any snapshot was replaced, in
+// which case readers should reopen their connections.
+func (m *Manager) Refresh(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changed bool
+	for _, src := range m.sources {
+		fp, err := fingerprint(src.Path)
+		if err != nil {
+			return changed, err
+		}
+
+		prev, err := readFingerprint(src.Dest)
+		if err == nil && fp == prev {
+			if _, err := os.Stat(src.Dest); err == nil {
+				continue
+			}
+		}
+
+		log.Printf("Source %s changed. Taking a new snapshot...", src.Path)
+		if err := backup(ctx, src.Path, src.Dest); err != nil {
+			return changed, err
+		}
+		if err := writeFingerprint(src.Dest, fp); err != nil {
+			return true, err
+		}
+		log.Printf("Snapshot of %s written to %s", src.Path, src.Dest)
+		changed = true
+	}
+	return changed, nil
+}
+
+// fingerprint summarises the size and modification time of a database and
+// its WAL. The WAL is also hashed, since it can be rewritten in place
+// without changing size within the filesystem's mtime resolution.
+func fingerprint(path string) (string, error) {
+	var infos []fileInfo
+	for _, suffix := range sidecars {
+		p := path + suffix
+		st, err := os.Stat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && suffix != "" {
+				continue
+			}
+			return "", fmt.Errorf("failed to stat %s: %w", p, err)
+		}
+		if suffix != "" && st.Size() == 0 {
+			// An empty WAL holds no data; readers create and remove it.
+			continue
+		}
+		fi := fileInfo{Name: filepath.Base(p), Size: st.Size(), ModTime: st.ModTime()}
+		if suffix == "-wal" {
+			if fi.Hash, err = hashFile(p); err != nil {
+				return "", err
+			}
+		}
+		infos = append(infos, fi)
+	}
+
+	b, err := json.Marshal(infos)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode fingerprint: %w", err)
+	}
+	return string(b), nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintPath is where the fingerprint of a snapshot's source is kept, so
+// one-off runs can tell whether the snapshot is still current.
+func fingerprintPath(dest string) string {
+	return dest + ".snapshot"
+}
+
+func readFingerprint(dest string) (string, error) {
+	b, err := os.ReadFile(fingerprintPath(dest))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeFingerprint(dest, fp string) error {
+	p := fingerprintPath(dest)
+	if err := os.WriteFile(p, []byte(fp), 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot fingerprint %s: %w", p, err)
+	}
+	return nil
+}
+
+// backup copies src to dest with SQLite's online backup API, which yields a
+// consistent copy including pages still in the WAL. The copy is written to a
+// temporary file and renamed over dest.
+func backup(ctx context.Context, src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory for %s: %w", dest, err)
+	}
+
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+
+	if err := backupTo(ctx, src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to move snapshot %s into place: %w", dest, err)
+	}
+	return nil
+}
+
+func backupTo(ctx context.Context, src, dest string) error {
+	srcDB, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", src))
+	if err != nil {
+		return fmt.Errorf("failed to open source database %s: %w", src, err)
+	}
+	defer srcDB.Close()
+
+	destDB, err := sql.Open("sqlite3", dest)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot database %s: %w", dest, err)
+	}
+	defer destDB.Close()
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to source database %s: %w", src, err)
+	}
+	defer srcConn.Close()
+
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to snapshot database %s: %w", dest, err)
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(destRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			return runBackup(ctx, destRaw.(*sqlite3.SQLiteConn), srcRaw.(*sqlite3.SQLiteConn))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to back up %s: %w", src, err)
+	}
+
+	// The copy inherits WAL mode from the source. Switch it back to a plain
+	// rollback journal so it can be opened read-only without sidecar files.
+	if _, err := destConn.ExecContext(ctx, "PRAGMA journal_mode=DELETE"); err != nil {
+		return fmt.Errorf("failed to set journal mode on snapshot %s: %w", dest, err)
+	}
+	return nil
+}
+
+// runBackup copies every page from src to dest, retrying while Apple Books
+// holds a lock on the source.
+func runBackup(ctx context.Context, dest, src *sqlite3.SQLiteConn) error {
+	b, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := b.Step(-1)
+		if err != nil {
+			b.Close()
+			return err
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			b.Close()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,94 @@
+package snapshot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// count returns the number of rows in the snapshot at path, opened the way
+// the annotation store opens it.
+func count(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM t").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRefreshCopiesWAL(t *testing.T) {
+	dir := t.TempDir()
+	live := filepath.Join(dir, "live", "db.sqlite")
+	dest := filepath.Join(dir, "snapshots", "db.sqlite")
+	if err := os.MkdirAll(filepath.Dir(live), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the live database open in WAL mode without checkpoints, as Apple
+	// Books does, so new rows only exist in the -wal file.
+	db, err := sql.Open("sqlite3", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, q := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA wal_autocheckpoint=0",
+		"CREATE TABLE t (v TEXT)",
+		"INSERT INTO t VALUES ('a')",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := New(Source{Path: live, Dest: dest})
+	ctx := context.Background()
+	changed, err := m.Refresh(ctx)
+	if err != nil || !changed {
+		t.Fatalf("first Refresh() = %v, %v; want a snapshot", changed, err)
+	}
+	if n := count(t, dest); n != 1 {
+		t.Errorf("snapshot has %d row(s), want 1", n)
+	}
+	if _, err := os.Stat(dest + "-wal"); err == nil {
+		t.Error("snapshot left a -wal file behind")
+	}
+
+	if changed, err := m.Refresh(ctx); err != nil || changed {
+		t.Errorf("Refresh() without changes = %v, %v; want no snapshot", changed, err)
+	}
+
+	if _, err := db.Exec("INSERT INTO t VALUES ('b')"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := m.Refresh(ctx); err != nil || !changed {
+		t.Fatalf("Refresh() after a write = %v, %v; want a snapshot", changed, err)
+	}
+	if n := count(t, dest); n != 2 {
+		t.Errorf("snapshot has %d row(s) after a write, want 2", n)
+	}
+
+	// A new manager, as in the next one-off run, reuses a current snapshot.
+	if changed, err := New(Source{Path: live, Dest: dest}).Refresh(ctx); err != nil || changed {
+		t.Errorf("Refresh() in a new run = %v, %v; want the snapshot reused", changed, err)
+	}
+}
+
+func TestRefreshMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	m := New(Source{Path: filepath.Join(dir, "missing.sqlite"), Dest: filepath.Join(dir, "copy.sqlite")})
+	if _, err := m.Refresh(context.Background()); err == nil {
+		t.Error("Refresh() of a missing database succeeded")
+	}
+}
@@ -6,22 +6,86 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
+// Version is the current state file format. Version 1 only tracked a single
+// LastPK high-water mark; files in that format are treated as empty so that
+// every annotation is re-exported once.
+const Version = 2
+
+// Annotation records what was last exported for a single annotation. Text,
+// Note and the position fields are kept so a deleted annotation can still be
+// rendered as a tombstone, in its place, after it has disappeared from the
+// Apple Books database.
+type Annotation struct {
+	AssetID       string    `json:"asset_id"`
+	Hash          string    `json:"hash"`
+	Modified      time.Time `json:"modified"`
+	Created       time.Time `json:"created,omitzero"`
+	Text          string    `json:"text,omitempty"`
+	Note          string    `json:"note,omitempty"`
+	Location      string    `json:"location,omitempty"`
+	LocationStart int64     `json:"location_start,omitempty"`
+	Deleted       bool      `json:"deleted,omitempty"`
+	DeletedAt     time.Time `json:"deleted_at,omitzero"`
+}
+
+// FailedBook is an entry in the retry queue for a book whose export failed.
+type FailedBook struct {
+	Title       string    `json:"title"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// Book records the title and author a book was last exported with, and the
+// note it was exported to. Note is relative to the vault and slash-separated.
+type Book struct {
+	Title  string `json:"title"`
+	Author string `json:"author,omitempty"`
+	Note   string `json:"note,omitempty"`
+	// Stale is set when the note path template changed since the book was
+	// exported, so its note is moved on the next sync.
+	Stale bool `json:"stale,omitempty"`
+	// Frontmatter holds hashes of the owned frontmatter values last written
+	// to the note, keyed by frontmatter key, to tell user edits apart from
+	// values booksync wrote itself.
+	Frontmatter map[string]string `json:"frontmatter,omitempty"`
+}
+
 type File struct {
-	Path   string `json:"-"`
-	LastPK int64  `json:"last_pk"`
+	Path        string                `json:"-"`
+	Version     int                   `json:"version"`
+	Annotations map[string]Annotation `json:"annotations"`      // keyed by ZANNOTATIONUUID
+	Books       map[string]Book       `json:"books,omitempty"`  // keyed by asset ID
+	Failed      map[string]FailedBook `json:"failed,omitempty"` // keyed by asset ID
+	// PathTemplate is the note path template books were exported with.
+	PathTemplate string `json:"path_template,omitempty"`
+}
+
+// ChangeSet lists annotation UUIDs by how they differ from the state file.
+type ChangeSet struct {
+	Added   []string
+	Changed []string
+	Deleted []string
+}
+
+// Empty reports whether the change set contains no changes.
+func (c ChangeSet) Empty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Deleted) == 0
 }
 
 func Load(dir string) (*File, error) {
 	p := filepath.Join(dir, "booksync_state.json")
-	s := &File{Path: p, LastPK: 0}
+	s := &File{Path: p, Version: Version, Annotations: map[string]Annotation{}, Books: map[string]Book{}, Failed: map[string]FailedBook{}}
 
 	log.Printf("Attempting to load state from: %s", p)
 	b, err := os.ReadFile(p)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			log.Printf("State file not found at %s. Starting with default state (LastPK=0).", p)
+			log.Printf("State file not found at %s. Starting with empty state.", p)
 			return s, nil
 		}
 		log.Printf("Error reading state file %s: %v", p, err)
@@ -29,17 +93,181 @@ func Load(dir string) (*File, error) {
 	}
 
 	if err := json.Unmarshal(b, s); err != nil {
-		log.Printf("Error unmarshalling state file %s: %v. Using default state.", p, err)
-		s.LastPK = 0
+		log.Printf("Error unmarshalling state file %s: %v. Using empty state.", p, err)
+		s.Annotations = map[string]Annotation{}
 	}
 
-	log.Printf("Successfully loaded state: LastPK=%d", s.LastPK)
+	if s.Version < Version {
+		log.Printf("State file %s uses format version %d. All annotations will be re-exported.", p, s.Version)
+		s.Version = Version
+		s.Annotations = map[string]Annotation{}
+	}
+	if s.Annotations == nil {
+		s.Annotations = map[string]Annotation{}
+	}
+	if s.Books == nil {
+		s.Books = map[string]Book{}
+	}
+	if s.Failed == nil {
+		s.Failed = map[string]FailedBook{}
+	}
+
+	log.Printf("Successfully loaded state: %d tracked annotation(s), %d book(s) queued for retry", len(s.Annotations), len(s.Failed))
 	return s, nil
 }
 
+// Diff compares the annotations currently in the library against the state
+// file. An annotation is changed when its content hash or modification date
+// differs from what was last exported, or when it reappears after having been
+// deleted. Annotations already recorded as deleted are not reported again.
+func (f *File) Diff(current map[string]Annotation) ChangeSet {
+	var cs ChangeSet
+	for uuid, cur := range current {
+		prev, ok := f.Annotations[uuid]
+		switch {
+		case !ok:
+			cs.Added = append(cs.Added, uuid)
+		case prev.Deleted || prev.Hash != cur.Hash || !prev.Modified.Equal(cur.Modified):
+			cs.Changed = append(cs.Changed, uuid)
+		}
+	}
+	for uuid, prev := range f.Annotations {
+		if _, ok := current[uuid]; !ok && !prev.Deleted {
+			cs.Deleted = append(cs.Deleted, uuid)
+		}
+	}
+
+	sort.Strings(cs.Added)
+	sort.Strings(cs.Changed)
+	sort.Strings(cs.Deleted)
+	return cs
+}
+
+// Record marks an annotation as exported.
+func (f *File) Record(uuid string, a Annotation) {
+	f.Annotations[uuid] = a
+}
+
+// MarkDeleted turns a tracked annotation into a tombstone. The content and
+// position the state file lacks, as in files written by earlier versions,
+// are filled in from row: the deleted annotation as Apple Books still has
+// it, or the zero Annotation once it was purged.
+func (f *File) MarkDeleted(uuid string, at time.Time, row Annotation) {
+	a := f.Annotations[uuid]
+	a.Deleted = true
+	a.DeletedAt = at
+	if a.Text == "" {
+		a.Text = row.Text
+	}
+	if a.Note == "" {
+		a.Note = row.Note
+	}
+	if a.Location == "" {
+		a.Location = row.Location
+	}
+	if a.LocationStart == 0 {
+		a.LocationStart = row.LocationStart
+	}
+	if a.Created.IsZero() {
+		a.Created = row.Created
+	}
+	f.Annotations[uuid] = a
+}
+
+// Tombstones returns the UUIDs of a book's deleted annotations, ordered by
+// deletion time.
+func (f *File) Tombstones(assetID string) []string {
+	var out []string
+	for uuid, a := range f.Annotations {
+		if a.Deleted && a.AssetID == assetID {
+			out = append(out, uuid)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := f.Annotations[out[i]], f.Annotations[out[j]]
+		if !a.DeletedAt.Equal(b.DeletedAt) {
+			return a.DeletedAt.Before(b.DeletedAt)
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// BookChanged reports whether a book's title or author differs from when it
+// was last exported, whether it was never recorded, or whether its note has
+// to be moved to a new path.
+func (f *File) BookChanged(assetID, title, author string) bool {
+	b, ok := f.Books[assetID]
+	return !ok || b.Stale || b.Title != title || b.Author != author
+}
+
+// RecordBook records the title and author a book was exported with.
+func (f *File) RecordBook(assetID, title, author string) {
+	b := f.Books[assetID]
+	b.Title = title
+	b.Author = author
+	b.Stale = false
+	f.Books[assetID] = b
+}
+
+// SetPathTemplate records the note path template in use. If books were
+// exported with a different one, they are all marked stale so their notes
+// are moved on the next sync.
+func (f *File) SetPathTemplate(tpl string) {
+	if f.PathTemplate != "" && f.PathTemplate != tpl {
+		for assetID, b := range f.Books {
+			b.Stale = true
+			f.Books[assetID] = b
+		}
+	}
+	f.PathTemplate = tpl
+}
+
+// NotePath returns the note a book was last exported to, or "" if unknown.
+func (f *File) NotePath(assetID string) string {
+	return f.Books[assetID].Note
+}
+
+// SetNotePath records the note a book was exported to.
+func (f *File) SetNotePath(assetID, path string) {
+	b := f.Books[assetID]
+	b.Note = path
+	f.Books[assetID] = b
+}
+
+// Frontmatter returns the hashes of the owned frontmatter values last written
+// to a book's note.
+func (f *File) Frontmatter(assetID string) map[string]string {
+	return f.Books[assetID].Frontmatter
+}
+
+// SetFrontmatter records the hashes of the owned frontmatter values written
+// to a book's note.
+func (f *File) SetFrontmatter(assetID string, hashes map[string]string) {
+	b := f.Books[assetID]
+	b.Frontmatter = hashes
+	f.Books[assetID] = b
+}
+
+// RecordFailure adds a book to the retry queue, or bumps its attempt count if
+// it is already queued.
+func (f *File) RecordFailure(assetID, title string, err error) {
+	fb := f.Failed[assetID]
+	fb.Title = title
+	fb.Attempts++
+	fb.LastError = err.Error()
+	fb.LastAttempt = time.Now()
+	f.Failed[assetID] = fb
+}
+
+// ClearFailure removes a book from the retry queue.
+func (f *File) ClearFailure(assetID string) {
+	delete(f.Failed, assetID)
+}
+
 func (f *File) Save() error {
 	tmp := f.Path + ".tmp"
-	log.Printf("Attempting to save state (LastPK=%d) to temporary file: %s", f.LastPK, tmp)
+	log.Printf("Attempting to save state (%d annotations) to temporary file: %s", len(f.Annotations), tmp)
 	b, err := json.MarshalIndent(f, "", "  ")
 	if err != nil {
 		log.Printf("Error marshalling state: %v", err)
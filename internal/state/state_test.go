@@ -0,0 +1,175 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	t0 := time.Date(2024, time.March, 9, 14, 30, 0, 0, time.UTC)
+	f := &File{Annotations: map[string]Annotation{
+		"same":     {AssetID: "A1", Hash: "h1", Modified: t0},
+		"edited":   {AssetID: "A1", Hash: "h2", Modified: t0},
+		"touched":  {AssetID: "A1", Hash: "h3", Modified: t0},
+		"deleted":  {AssetID: "A2", Hash: "h4", Modified: t0},
+		"deleted2": {AssetID: "A1", Hash: "h5", Modified: t0},
+	}}
+	current := map[string]Annotation{
+		"same":    {AssetID: "A1", Hash: "h1", Modified: t0.In(time.Local)},
+		"edited":  {AssetID: "A1", Hash: "h2'", Modified: t0},
+		"touched": {AssetID: "A1", Hash: "h3", Modified: t0.Add(time.Second)},
+		"new2":    {AssetID: "A1", Hash: "h7"},
+		"new":     {AssetID: "A3", Hash: "h6"},
+	}
+
+	cs := f.Diff(current)
+	if want := []string{"new", "new2"}; !slices.Equal(cs.Added, want) {
+		t.Errorf("Added = %v, want %v", cs.Added, want)
+	}
+	if want := []string{"edited", "touched"}; !slices.Equal(cs.Changed, want) {
+		t.Errorf("Changed = %v, want %v", cs.Changed, want)
+	}
+	if want := []string{"deleted", "deleted2"}; !slices.Equal(cs.Deleted, want) {
+		t.Errorf("Deleted = %v, want %v", cs.Deleted, want)
+	}
+	if cs.Empty() {
+		t.Error("Empty() = true for a change set with changes")
+	}
+	if cs := f.Diff(f.Annotations); !cs.Empty() {
+		t.Errorf("Diff against itself = %+v, want no changes", cs)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, time.March, 9, 14, 30, 0, 0, time.UTC)
+	f.Record("H1", Annotation{AssetID: "A1", Hash: "h1", Modified: modified})
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := f.Annotations["H1"]; f.Version != Version || a.AssetID != "A1" || a.Hash != "h1" || !a.Modified.Equal(modified) {
+		t.Errorf("loaded version %d, H1 = %+v", f.Version, a)
+	}
+}
+
+// TestLoadVersion1 checks that a state file with only a LastPK high-water
+// mark is read as empty, so every annotation is exported again.
+func TestLoadVersion1(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "booksync_state.json"), []byte(`{"last_pk": 1234}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != Version || len(f.Annotations) != 0 {
+		t.Errorf("loaded version %d with %d annotation(s), want version %d and none", f.Version, len(f.Annotations), Version)
+	}
+}
+
+func TestDiffTombstones(t *testing.T) {
+	f := &File{Annotations: map[string]Annotation{
+		"gone":     {AssetID: "A1", Hash: "h1", Deleted: true},
+		"restored": {AssetID: "A1", Hash: "h2", Deleted: true},
+	}}
+	cs := f.Diff(map[string]Annotation{"restored": {AssetID: "A1", Hash: "h2"}})
+	if len(cs.Deleted) != 0 || !slices.Equal(cs.Changed, []string{"restored"}) || len(cs.Added) != 0 {
+		t.Errorf("Diff = %+v, want only the restored annotation changed", cs)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	t0 := time.Date(2024, time.March, 9, 14, 30, 0, 0, time.UTC)
+	f := &File{Annotations: map[string]Annotation{
+		"H1": {AssetID: "A1", Text: "first", Note: "mine"},
+		"H2": {AssetID: "A1"},
+		"H3": {AssetID: "A1", Text: "live"},
+		"H4": {AssetID: "A2", Text: "other book"},
+		"H5": {AssetID: "A1", Text: "fifth"},
+	}}
+	f.MarkDeleted("H1", t0.Add(time.Minute), Annotation{Text: "from the library"})
+	f.MarkDeleted("H2", t0, Annotation{Text: "second", Note: "a note", Location: "epubcfi(/6/4!/4/2/1:0)", LocationStart: 120, Created: t0.Add(-time.Hour)})
+	f.MarkDeleted("H4", t0, Annotation{})
+	f.MarkDeleted("H5", t0.Add(time.Minute), Annotation{})
+
+	if got, want := f.Tombstones("A1"), []string{"H2", "H1", "H5"}; !slices.Equal(got, want) {
+		t.Errorf("Tombstones(A1) = %v, want %v", got, want)
+	}
+	// Content already in the state file wins over what the library has left.
+	if a := f.Annotations["H1"]; a.Text != "first" || a.Note != "mine" || !a.DeletedAt.Equal(t0.Add(time.Minute)) {
+		t.Errorf("H1 = %+v", a)
+	}
+	if a := f.Annotations["H2"]; a.Text != "second" || a.Note != "a note" || a.Location == "" || a.LocationStart != 120 || !a.Created.Equal(t0.Add(-time.Hour)) {
+		t.Errorf("H2 = %+v, want the content and position it was deleted with", a)
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.RecordFailure("A1", "Dune", errors.New("disk full"))
+	f.RecordFailure("A1", "Dune", errors.New("permission denied"))
+	f.RecordFailure("A2", "Emma", errors.New("disk full"))
+	f.ClearFailure("A2")
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Failed) != 1 {
+		t.Fatalf("Failed = %+v, want only A1 queued", f.Failed)
+	}
+	if fb := f.Failed["A1"]; fb.Title != "Dune" || fb.Attempts != 2 || fb.LastError != "permission denied" || fb.LastAttempt.IsZero() {
+		t.Errorf("A1 = %+v, want two attempts ending in the last error", fb)
+	}
+}
+
+func TestBooks(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.BookChanged("A1", "Dune", "Frank Herbert") {
+		t.Error("an unrecorded book is unchanged")
+	}
+	f.SetNotePath("A1", "apple_books_sync/dune.md")
+	f.RecordBook("A1", "Dune", "Frank Herbert")
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BookChanged("A1", "Dune", "Frank Herbert") || !f.BookChanged("A1", "Dune Messiah", "Frank Herbert") {
+		t.Errorf("BookChanged after recording %+v", f.Books["A1"])
+	}
+	if got := f.NotePath("A1"); got != "apple_books_sync/dune.md" {
+		t.Errorf("NotePath(A1) = %q", got)
+	}
+	if got := f.NotePath("A2"); got != "" {
+		t.Errorf("NotePath(A2) = %q, want none", got)
+	}
+}
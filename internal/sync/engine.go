@@ -0,0 +1,328 @@
+// Package sync reconciles the Apple Books library with the notes in a vault.
+// It is shared by the one-off sync command and watch mode.
+package sync
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation"
+	"github.com/naimoon6450/booksync/internal/exporter"
+	"github.com/naimoon6450/booksync/internal/state"
+)
+
+// Store is the part of annotation.Store the engine reads from.
+type Store interface {
+	Highlights(afterPK int64) iter.Seq2[*annotation.Highlight, error]
+	GetHighlightsForBook(assetID string) ([]*annotation.Highlight, error)
+	GetDeletedHighlights() ([]*annotation.Highlight, error)
+	GetBook(assetID string) (book annotation.BookInfo, unknown bool, err error)
+}
+
+// Sink receives every book that needs to be re-rendered. *exporter.Exporter
+// is the standard sink.
+type Sink interface {
+	WriteBook(bookData exporter.BookData) error
+}
+
+// BookError records a book that could not be exported.
+type BookError struct {
+	AssetID string
+	Title   string
+	Err     error
+}
+
+func (e BookError) Error() string {
+	return fmt.Sprintf("book '%s' (%s): %v", e.Title, e.AssetID, e.Err)
+}
+
+func (e BookError) Unwrap() error {
+	return e.Err
+}
+
+// Result summarises a sync pass.
+type Result struct {
+	BooksWritten int
+	Added        int
+	Changed      int
+	Deleted      int
+	// Errors lists the books that failed to export in this pass.
+	Errors []BookError
+	// Pending is the number of books queued for retry after this pass.
+	Pending int
+}
+
+// Engine runs sync passes between a store and one or more sinks, recording
+// progress in a state file.
+type Engine struct {
+	store Store
+	state *state.File
+	sinks []Sink
+}
+
+func New(store Store, st *state.File, sinks ...Sink) *Engine {
+	return &Engine{
+		store: store,
+		state: st,
+		sinks: sinks,
+	}
+}
+
+// write passes a book to every sink, failing if any of them fails.
+func (e *Engine) write(bookData exporter.BookData) error {
+	for _, sink := range e.sinks {
+		if err := sink.WriteBook(bookData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointInterval is how often a sync pass saves the state file while
+// writing books. The rest is saved when the pass ends.
+const checkpointInterval = time.Second
+
+// bookInfo is the title and author of a book, kept for every book while the
+// library is scanned so renamed books can be detected.
+type bookInfo struct {
+	title   string
+	author  string
+	unknown bool
+}
+
+// Run performs one sync pass: it compares the library against the state
+// file, re-renders every book with added, changed or deleted highlights (and
+// every book queued for retry), and checkpoints the state file as books are
+// written, so an interrupted pass keeps the books it finished. Book failures
+// are reported in the result; the returned error is only set when the pass
+// could not run or its state could not be saved.
+//
+// The library is streamed once, keeping only the asset ID, digest and
+// modification date of each highlight, and each touched book is then read
+// and written on its own. The text of highlights is therefore only held for
+// one book at a time, however many highlights are exported.
+func (e *Engine) Run(ctx context.Context) (Result, error) {
+	// Compare the library against the state file by annotation UUID.
+	current := make(map[string]state.Annotation)
+	books := make(map[string]bookInfo)
+	for h, err := range e.store.Highlights(0) {
+		if err != nil {
+			return Result{}, fmt.Errorf("failed to get highlights: %w", err)
+		}
+		current[h.Key()] = state.Annotation{
+			AssetID:  h.AssetID,
+			Hash:     h.Hash(),
+			Modified: h.ModifiedAt,
+		}
+		if _, ok := books[h.AssetID]; !ok {
+			books[h.AssetID] = bookInfo{title: h.BookTitle, author: h.BookAuthor, unknown: h.UnknownBook}
+		}
+	}
+	log.Printf("Read %d highlight(s) in %d book(s)", len(current), len(books))
+
+	deletedRows, err := e.store.GetDeletedHighlights()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to get deleted highlights: %w", err)
+	}
+
+	changes := e.state.Diff(current)
+	res := Result{
+		Added:   len(changes.Added),
+		Changed: len(changes.Changed),
+		Deleted: len(changes.Deleted),
+	}
+	// Books renamed in Apple Books (or given a title for an orphaned asset)
+	// are re-rendered so their notes follow the new title.
+	var renamed []string
+	for assetID, info := range books {
+		if e.state.BookChanged(assetID, info.title, info.author) {
+			renamed = append(renamed, assetID)
+		}
+	}
+	if changes.Empty() && len(renamed) == 0 && len(e.state.Failed) == 0 {
+		log.Printf("No highlight changes found (%d tracked).", len(e.state.Annotations))
+		return res, nil
+	}
+
+	log.Printf("Found %d added, %d changed and %d deleted highlight(s).", res.Added, res.Changed, res.Deleted)
+
+	// Deleted highlights become tombstones when their book is processed, so
+	// the state file never records a deletion whose note wasn't re-rendered.
+	// Soft-deleted rows still carry the content and deletion time; purged
+	// rows fall back to what state remembers.
+	deletedByKey := make(map[string]*annotation.Highlight, len(deletedRows))
+	for _, h := range deletedRows {
+		deletedByKey[h.Key()] = h
+	}
+
+	touchedAssets := make(map[string]bool)
+	deletedByAsset := make(map[string][]string)
+	for _, key := range changes.Deleted {
+		assetID := e.state.Annotations[key].AssetID
+		touchedAssets[assetID] = true
+		deletedByAsset[assetID] = append(deletedByAsset[assetID], key)
+	}
+
+	// Collect the books touched by added, changed or deleted highlights, plus
+	// the books queued for retry after a failed export. Each touched book is
+	// re-rendered from its complete set of highlights so earlier highlights
+	// are never dropped from the note.
+	for _, key := range append(changes.Added, changes.Changed...) {
+		touchedAssets[current[key].AssetID] = true
+	}
+	for _, assetID := range renamed {
+		touchedAssets[assetID] = true
+	}
+	for assetID, fb := range e.state.Failed {
+		log.Printf("Retrying export for book '%s' (attempt %d, last error: %s)", fb.Title, fb.Attempts+1, fb.LastError)
+		touchedAssets[assetID] = true
+	}
+
+	// Each book has its own note, identified by asset ID. Books that no
+	// longer have live highlights are looked up for their tombstones.
+	failedAssets := make(map[string]error)
+	for assetID := range touchedAssets {
+		if _, ok := books[assetID]; ok {
+			continue
+		}
+		if len(e.state.Tombstones(assetID)) == 0 && len(deletedByAsset[assetID]) == 0 {
+			delete(touchedAssets, assetID)
+			e.state.ClearFailure(assetID)
+			continue
+		}
+		// Every highlight of this book was deleted.
+		book, unknown, err := e.store.GetBook(assetID)
+		if err != nil {
+			log.Printf("ERROR: Export failed for asset %s: %v", assetID, err)
+			books[assetID] = bookInfo{title: assetID}
+			failedAssets[assetID] = err
+			continue
+		}
+		books[assetID] = bookInfo{title: book.Title, author: book.Author, unknown: unknown}
+	}
+
+	log.Printf("Processing %d book(s)...", len(touchedAssets)-len(failedAssets))
+
+	lastSave := time.Now()
+	for _, assetID := range slices.Sorted(maps.Keys(touchedAssets)) {
+		if err := ctx.Err(); err != nil {
+			// Keep the books written so far.
+			if saveErr := e.state.Save(); saveErr != nil {
+				return res, fmt.Errorf("failed to save state after update: %w", saveErr)
+			}
+			return res, err
+		}
+		info := books[assetID]
+		for _, key := range deletedByAsset[assetID] {
+			deletedAt := time.Now()
+			var row state.Annotation
+			if h, ok := deletedByKey[key]; ok {
+				deletedAt, row = h.ModifiedAt, exported(h)
+			}
+			e.state.MarkDeleted(key, deletedAt, row)
+		}
+
+		err, failed := failedAssets[assetID]
+		var rows []*annotation.Highlight
+		if !failed {
+			var data *exporter.BookData
+			data, rows, err = e.loadBook(assetID, info)
+			if err == nil {
+				err = e.write(*data)
+			}
+			if err != nil {
+				log.Printf("ERROR: Export failed for book '%s': %v", info.title, err)
+			}
+		}
+
+		// Checkpoint the book: the highlights as they were written, with
+		// their content for tombstones. Annotations of books that failed to
+		// export are not recorded, so they are picked up again on the next
+		// run; those of untouched books are unchanged.
+		if err != nil {
+			e.state.RecordFailure(assetID, info.title, err)
+			res.Errors = append(res.Errors, BookError{AssetID: assetID, Title: info.title, Err: err})
+		} else {
+			for _, h := range rows {
+				e.state.Record(h.Key(), exported(h))
+			}
+			e.state.RecordBook(assetID, info.title, info.author)
+			e.state.ClearFailure(assetID)
+			res.BooksWritten++
+		}
+		// Saving rewrites the whole file, so large passes checkpoint at most
+		// once per checkpointInterval rather than after every book.
+		if time.Since(lastSave) >= checkpointInterval {
+			if err := e.state.Save(); err != nil {
+				return res, fmt.Errorf("failed to save state after update: %w", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+	res.Pending = len(e.state.Failed)
+
+	if err := e.state.Save(); err != nil {
+		return res, fmt.Errorf("failed to save state after update: %w", err)
+	}
+	log.Printf("State saved successfully with %d tracked annotation(s)", len(e.state.Annotations))
+	return res, nil
+}
+
+// exported returns the state record of a highlight as it is written: its
+// digest, plus the content and position its tombstone is rendered from.
+func exported(h *annotation.Highlight) state.Annotation {
+	return state.Annotation{
+		AssetID:       h.AssetID,
+		Hash:          h.Hash(),
+		Modified:      h.ModifiedAt,
+		Created:       h.CreatedAt,
+		Text:          h.HighlightText,
+		Note:          h.Note,
+		Location:      h.Location,
+		LocationStart: h.LocationStart,
+	}
+}
+
+// loadBook reads the highlights of a book, followed by its tombstones; the
+// exporter's deletion policy decides whether those are removed, struck
+// through or archived. The live highlights are also returned as read from
+// the store.
+func (e *Engine) loadBook(assetID string, info bookInfo) (*exporter.BookData, []*annotation.Highlight, error) {
+	highlights, err := e.store.GetHighlightsForBook(assetID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := &exporter.BookData{
+		AssetID:     assetID,
+		Title:       info.title,
+		Author:      info.author,
+		UnknownBook: info.unknown,
+		Highlights:  make([]exporter.Highlight, 0, len(highlights)),
+		LastSynced:  time.Now(),
+	}
+	for _, h := range highlights {
+		data.Highlights = append(data.Highlights, exporter.HighlightFrom(h))
+	}
+	for _, key := range e.state.Tombstones(assetID) {
+		ann := e.state.Annotations[key]
+		data.Highlights = append(data.Highlights, exporter.Highlight{
+			UUID:          key,
+			AssetID:       ann.AssetID,
+			Text:          ann.Text,
+			Note:          ann.Note,
+			Created:       ann.Created,
+			Modified:      ann.Modified,
+			Location:      ann.Location,
+			LocationStart: ann.LocationStart,
+			Deleted:       true,
+			DeletedAt:     ann.DeletedAt,
+		})
+	}
+	return data, highlights, nil
+}
@@ -0,0 +1,344 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation"
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+	"github.com/naimoon6450/booksync/internal/exporter"
+	"github.com/naimoon6450/booksync/internal/state"
+)
+
+// recorder is a Sink remembering the books written to it.
+type recorder struct {
+	books []exporter.BookData
+}
+
+func (r *recorder) WriteBook(b exporter.BookData) error {
+	r.books = append(r.books, b)
+	return nil
+}
+
+func quiet(tb testing.TB) *log.Logger {
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(prev) })
+	return log.New(io.Discard, "", 0)
+}
+
+func openStore(tb testing.TB, fx *annotationtest.Library, logger *log.Logger) *annotation.Store {
+	tb.Helper()
+	store, err := annotation.NewStore(fx.AnnotationPath, fx.LibraryPath, annotation.Options{Logger: logger})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRunRecordsTouchedBooks(t *testing.T) {
+	logger := quiet(t)
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddBook("A2", "Emma", "Jane Austen")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer.", Note: "Litany", Location: "epubcfi(/6/4!/4/2/1:0)"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "The spice must flow."})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", UUID: "H3", Text: "Badly done, Emma!"})
+
+	st, err := state.Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recorder{}
+	engine := New(openStore(t, fx, logger), st, sink)
+
+	res, err := engine.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BooksWritten != 2 || res.Added != 3 {
+		t.Fatalf("first run: %+v", res)
+	}
+	if a := st.Annotations["H1"]; a.Text != "Fear is the mind-killer." || a.Note != "Litany" || a.Hash == "" {
+		t.Errorf("H1 recorded as %+v", a)
+	}
+
+	// Purge H1 from the database: its tombstone is rendered from the text
+	// recorded when it was exported. Emma is untouched.
+	fx.Exec("DELETE FROM ZAEANNOTATION WHERE ZANNOTATIONUUID = 'H1'")
+	sink.books = nil
+	res, err = engine.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Deleted != 1 || len(sink.books) != 1 || sink.books[0].AssetID != "A1" {
+		t.Fatalf("second run: %+v, wrote %d book(s)", res, len(sink.books))
+	}
+	var tombstone *exporter.Highlight
+	for i, h := range sink.books[0].Highlights {
+		if h.UUID == "H1" {
+			tombstone = &sink.books[0].Highlights[i]
+		}
+	}
+	if tombstone == nil || !tombstone.Deleted || tombstone.Text != "Fear is the mind-killer." || tombstone.Note != "Litany" || tombstone.Location != "epubcfi(/6/4!/4/2/1:0)" || tombstone.Created.IsZero() {
+		t.Errorf("tombstone = %+v", tombstone)
+	}
+
+	sink.books = nil
+	if res, err := engine.Run(context.Background()); err != nil || len(sink.books) != 0 {
+		t.Errorf("third run wrote %d book(s): %+v, %v", len(sink.books), res, err)
+	}
+}
+
+// flakySink fails to write a book a number of times before it succeeds.
+type flakySink struct {
+	recorder
+	assetID  string
+	failures int
+}
+
+func (f *flakySink) WriteBook(b exporter.BookData) error {
+	if b.AssetID == f.assetID && f.failures > 0 {
+		f.failures--
+		return errors.New("disk full")
+	}
+	return f.recorder.WriteBook(b)
+}
+
+func TestRunRetriesFailedBooks(t *testing.T) {
+	logger := quiet(t)
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddBook("A2", "Emma", "Jane Austen")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer."})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", UUID: "H2", Text: "Badly done, Emma!"})
+
+	dir := t.TempDir()
+	st, err := state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &flakySink{assetID: "A1", failures: 2}
+	engine := New(openStore(t, fx, logger), st, sink)
+
+	// The failure is queued and A1's highlights aren't recorded, while A2 is
+	// exported as usual.
+	res, err := engine.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BooksWritten != 1 || len(res.Errors) != 1 || res.Errors[0].AssetID != "A1" || res.Pending != 1 {
+		t.Fatalf("first run: %+v", res)
+	}
+	if _, ok := st.Annotations["H1"]; ok {
+		t.Error("H1 recorded although its book failed")
+	}
+	saved, err := state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fb := saved.Failed["A1"]; fb.Attempts != 1 || fb.LastError != "disk full" || fb.Title != "Dune" {
+		t.Errorf("saved retry queue = %+v", saved.Failed)
+	}
+
+	// Nothing changed in the library, but A1 is retried, and only A1.
+	sink.books = nil
+	res, err = engine.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Errors) != 1 || res.Pending != 1 || st.Failed["A1"].Attempts != 2 {
+		t.Fatalf("second run: %+v, queue %+v", res, st.Failed)
+	}
+
+	res, err = engine.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BooksWritten != 1 || len(res.Errors) != 0 || res.Pending != 0 || len(sink.books) != 1 || sink.books[0].AssetID != "A1" {
+		t.Fatalf("third run: %+v, wrote %v", res, sink.books)
+	}
+	if _, ok := st.Annotations["H1"]; !ok || len(st.Failed) != 0 {
+		t.Errorf("after the retry: H1 recorded %v, queue %+v", ok, st.Failed)
+	}
+
+	sink.books = nil
+	if res, err := engine.Run(context.Background()); err != nil || len(sink.books) != 0 {
+		t.Errorf("fourth run wrote %d book(s): %+v, %v", len(sink.books), res, err)
+	}
+}
+
+// cancellingSink cancels a context once it has written a book.
+type cancellingSink struct {
+	recorder
+	cancel context.CancelFunc
+}
+
+func (c *cancellingSink) WriteBook(b exporter.BookData) error {
+	c.cancel()
+	return c.recorder.WriteBook(b)
+}
+
+func TestRunSavesProgressWhenCancelled(t *testing.T) {
+	logger := quiet(t)
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddBook("A2", "Emma", "Jane Austen")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer."})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", UUID: "H2", Text: "Badly done, Emma!"})
+	store := openStore(t, fx, logger)
+
+	dir := t.TempDir()
+	st, err := state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &cancellingSink{cancel: cancel}
+	if _, err := New(store, st, sink).Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled run returned %v", err)
+	}
+	if len(sink.books) != 1 {
+		t.Fatalf("cancelled run wrote %d book(s)", len(sink.books))
+	}
+
+	// The book written before the cancellation is saved; the next run only
+	// writes the other one.
+	st, err = state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.Annotations["H1"]; !ok || st.Books["A1"].Title != "Dune" {
+		t.Fatalf("progress not saved: %+v", st)
+	}
+	rec := &recorder{}
+	if _, err := New(store, st, rec).Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.books) != 1 || rec.books[0].AssetID != "A2" {
+		t.Errorf("next run wrote %v", rec.books)
+	}
+}
+
+// TestRunKeepsTombstonesInPlace checks that a struck-through highlight stays
+// where it was in the note, whatever the order, after it is purged from the
+// database.
+func TestRunKeepsTombstonesInPlace(t *testing.T) {
+	logger := quiet(t)
+	for _, order := range []string{exporter.OrderPosition, exporter.OrderCreated, exporter.OrderModified} {
+		t.Run(order, func(t *testing.T) {
+			fx := annotationtest.New(t, t.TempDir())
+			fx.AddBook("A1", "Dune", "Frank Herbert")
+			created := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+			for i, text := range []string{"First passage.", "Second passage.", "Third passage."} {
+				fx.AddHighlight(annotationtest.Highlight{
+					AssetID:       "A1",
+					UUID:          fmt.Sprintf("H%d", i+1),
+					Text:          text,
+					Created:       created.Add(time.Duration(i) * time.Hour),
+					Location:      fmt.Sprintf("epubcfi(/6/4!/4/%d/1:0)", 2*(i+1)),
+					LocationStart: int64(100 * (i + 1)),
+				})
+			}
+
+			vault := t.TempDir()
+			st, err := state.Load(vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exp, err := exporter.New(vault, "obsidian", exporter.Options{Index: st, DeletionPolicy: exporter.DeletionStrikethrough, Order: order})
+			if err != nil {
+				t.Fatal(err)
+			}
+			engine := New(openStore(t, fx, logger), st, exp)
+			if _, err := engine.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			fx.Exec("DELETE FROM ZAEANNOTATION WHERE ZANNOTATIONUUID = 'H2'")
+			if _, err := engine.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(filepath.Join(vault, filepath.FromSlash(st.NotePath("A1"))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			note := string(b)
+			first, second, third := strings.Index(note, "First"), strings.Index(note, "~~Second"), strings.Index(note, "Third")
+			if first < 0 || second < first || third < second {
+				t.Errorf("tombstone out of place:\n%s", note)
+			}
+			if !strings.Contains(note, "highlight_count: 2\n") {
+				t.Errorf("tombstone counted as a highlight:\n%s", note)
+			}
+		})
+	}
+}
+
+// benchmarkLibrary generates a library of 200 books with 250 highlights each.
+func benchmarkLibrary(b *testing.B) *annotationtest.Library {
+	fx := annotationtest.New(b, b.TempDir())
+	fx.Generate(200, 250)
+	return fx
+}
+
+// BenchmarkRunInitial exports every book of a large library to a vault, as
+// the first sync does.
+func BenchmarkRunInitial(b *testing.B) {
+	logger := quiet(b)
+	fx := benchmarkLibrary(b)
+	store := openStore(b, fx, logger)
+	b.ReportAllocs()
+
+	for b.Loop() {
+		b.StopTimer()
+		dir := b.TempDir()
+		st, err := state.Load(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+		exp, err := exporter.New(dir, "", exporter.Options{Index: st, SkipCheck: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if _, err := New(store, st, exp).Run(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRunUnchanged scans a large library that has already been
+// exported, as most syncs in watch mode do.
+func BenchmarkRunUnchanged(b *testing.B) {
+	logger := quiet(b)
+	fx := benchmarkLibrary(b)
+	store := openStore(b, fx, logger)
+	dir := b.TempDir()
+	st, err := state.Load(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	engine := New(store, st, &recorder{})
+	if _, err := engine.Run(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+
+	for b.Loop() {
+		if _, err := engine.Run(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reason describes why a sync run was requested.
+type Reason string
+
+const (
+	ReasonStartup Reason = "startup"
+	ReasonFSEvent Reason = "fs event"
+	ReasonTicker  Reason = "ticker"
+	ReasonSignal  Reason = "signal"
+	// ReasonManual marks a run the user asked for, alongside the reason
+	// for how the request arrived, such as ReasonSignal for a SIGHUP.
+	ReasonManual Reason = "manual"
+)
+
+// RunFunc performs one sync pass. reasons lists every trigger that was
+// coalesced into the run.
+type RunFunc func(ctx context.Context, reasons []Reason)
+
+// Scheduler serializes sync runs on a single worker. Triggers arriving while
+// a run is already pending are coalesced into it, and triggers arriving while
+// a run is in progress schedule exactly one follow-up run.
+type Scheduler struct {
+	run      RunFunc
+	debounce time.Duration
+
+	wake chan struct{}
+
+	mu      sync.Mutex
+	pending map[Reason]bool
+	timer   *time.Timer
+}
+
+func NewScheduler(run RunFunc, debounce time.Duration) *Scheduler {
+	return &Scheduler{
+		run:      run,
+		debounce: debounce,
+		wake:     make(chan struct{}, 1),
+		pending:  make(map[Reason]bool),
+	}
+}
+
+// Trigger requests a run as soon as the worker is free, for one or more
+// reasons.
+func (s *Scheduler) Trigger(reasons ...Reason) {
+	s.mu.Lock()
+	if len(s.pending) > 0 {
+		log.Printf("Sync already pending, coalescing trigger (%s)", joinReasons(reasons))
+	}
+	for _, r := range reasons {
+		s.pending[r] = true
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Debounce requests a run once no further debounced triggers have arrived
+// for the scheduler's debounce interval.
+func (s *Scheduler) Debounce(reason Reason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(s.debounce, func() { s.Trigger(reason) })
+}
+
+// Run executes triggered runs one at a time until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	defer s.stopTimer()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		}
+
+		reasons := s.takePending()
+		if len(reasons) == 0 {
+			continue
+		}
+		log.Printf("Sync triggered (%s)", joinReasons(reasons))
+		s.run(ctx, reasons)
+	}
+}
+
+func (s *Scheduler) takePending() []Reason {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reasons := make([]Reason, 0, len(s.pending))
+	for r := range s.pending {
+		reasons = append(reasons, r)
+	}
+	clear(s.pending)
+
+	sort.Slice(reasons, func(i, j int) bool { return reasons[i] < reasons[j] })
+	return reasons
+}
+
+func (s *Scheduler) stopTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func joinReasons(reasons []Reason) string {
+	parts := make([]string, len(reasons))
+	for i, r := range reasons {
+		parts[i] = string(r)
+	}
+	return strings.Join(parts, ", ")
+}
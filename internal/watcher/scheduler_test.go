@@ -0,0 +1,118 @@
+package watcher
+
+import (
+	"context"
+	"io"
+	"log"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startScheduler runs a scheduler whose runs are reported on the returned
+// channel. Each run waits for release, if it is non-nil, before returning.
+func startScheduler(t *testing.T, debounce time.Duration, release <-chan struct{}) (*Scheduler, <-chan []Reason) {
+	t.Helper()
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	runs := make(chan []Reason, 16)
+	s := NewScheduler(func(ctx context.Context, reasons []Reason) {
+		runs <- reasons
+		if release != nil {
+			<-release
+		}
+	}, debounce)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	return s, runs
+}
+
+func nextRun(t *testing.T, runs <-chan []Reason) []Reason {
+	t.Helper()
+	select {
+	case r := <-runs:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a run")
+	}
+	return nil
+}
+
+func expectNoRun(t *testing.T, runs <-chan []Reason, wait time.Duration) {
+	t.Helper()
+	select {
+	case r := <-runs:
+		t.Fatalf("unexpected run (%s)", joinReasons(r))
+	case <-time.After(wait):
+	}
+}
+
+func TestSchedulerCoalescesPendingTriggers(t *testing.T) {
+	release := make(chan struct{})
+	s, runs := startScheduler(t, time.Hour, release)
+
+	s.Trigger(ReasonSignal, ReasonManual)
+	if got := nextRun(t, runs); !slices.Equal(got, []Reason{ReasonManual, ReasonSignal}) {
+		t.Fatalf("first run reasons = %v", got)
+	}
+
+	// Everything triggered while the first run is in progress is folded
+	// into exactly one follow-up run.
+	s.Trigger(ReasonTicker)
+	s.Trigger(ReasonStartup)
+	s.Trigger(ReasonTicker)
+	s.Trigger(ReasonFSEvent)
+	expectNoRun(t, runs, 20*time.Millisecond)
+	release <- struct{}{}
+
+	want := []Reason{ReasonFSEvent, ReasonStartup, ReasonTicker}
+	if got := nextRun(t, runs); !slices.Equal(got, want) {
+		t.Fatalf("follow-up run reasons = %v, want %v", got, want)
+	}
+	release <- struct{}{}
+	expectNoRun(t, runs, 50*time.Millisecond)
+}
+
+func TestSchedulerDebounce(t *testing.T) {
+	const debounce = 100 * time.Millisecond
+	s, runs := startScheduler(t, debounce, nil)
+
+	// A burst of events shorter than the debounce interval apart yields a
+	// single run, once the burst has settled.
+	var last time.Time
+	for range 5 {
+		s.Debounce(ReasonFSEvent)
+		last = time.Now()
+		time.Sleep(debounce / 4)
+	}
+	got := nextRun(t, runs)
+	if elapsed := time.Since(last); elapsed < debounce {
+		t.Errorf("run started %v after the last event, want at least %v", elapsed, debounce)
+	}
+	if !slices.Equal(got, []Reason{ReasonFSEvent}) {
+		t.Errorf("run reasons = %v", got)
+	}
+	expectNoRun(t, runs, 2*debounce)
+
+	// Immediate triggers don't wait for a pending debounce, and the
+	// debounced trigger still fires afterwards.
+	s.Debounce(ReasonFSEvent)
+	s.Trigger(ReasonSignal)
+	if got := nextRun(t, runs); !slices.Equal(got, []Reason{ReasonSignal}) {
+		t.Errorf("triggered run reasons = %v", got)
+	}
+	if got := nextRun(t, runs); !slices.Equal(got, []Reason{ReasonFSEvent}) {
+		t.Errorf("debounced run reasons = %v", got)
+	}
+}
@@ -4,125 +4,141 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/gosimple/slug"
 	"github.com/naimoon6450/booksync/internal/annotation"
-	"github.com/naimoon6450/booksync/internal/exporter"
-	"github.com/naimoon6450/booksync/internal/state"
+	"github.com/naimoon6450/booksync/internal/snapshot"
+	booksync "github.com/naimoon6450/booksync/internal/sync"
 )
 
-// WatchAndSync monitors the annotation database file for changes and triggers
-// synchronization of new highlights.
+// Options configures watch mode.
+type Options struct {
+	// Debounce is how long file events must settle before a sync runs.
+	Debounce time.Duration
+	// Interval is how often a sync runs regardless of file events.
+	Interval time.Duration
+}
+
+const (
+	defaultDebounce = 2 * time.Second
+	defaultInterval = 15 * time.Minute
+)
+
+// WatchAndSync monitors the live Apple Books databases (including their WAL
+// files) for changes and triggers synchronization of new highlights. Every
+// sync first refreshes the snapshots and reopens the store if they changed.
+// Syncs run one at a time on a scheduler; a SIGHUP requests an immediate,
+// manual one.
 func WatchAndSync(
 	ctx context.Context,
 	store *annotation.Store,
-	exp *exporter.Exporter,
-	st *state.File,
+	snap *snapshot.Manager,
+	eng *booksync.Engine,
+	opts Options,
 ) error {
+	if opts.Debounce <= 0 {
+		opts.Debounce = defaultDebounce
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("failed to create file watcher: %w", err)
 	}
 	defer w.Close()
 
-	if err := w.Add(filepath.Dir(st.Path)); err != nil {
-		return fmt.Errorf("failed to add path %s to watcher: %w", st.Path, err)
+	// Watch the directories of the live databases rather than the files, so
+	// WAL files and databases replaced by Apple Books are picked up too.
+	for _, src := range snap.Sources() {
+		dir := filepath.Dir(src.Path)
+		if err := w.Add(dir); err != nil {
+			return fmt.Errorf("failed to add path %s to watcher: %w", dir, err)
+		}
+		log.Printf("Watching %s for changes to %s", dir, filepath.Base(src.Path))
 	}
 
-	ticker := time.NewTicker(15 * time.Minute)
+	ticker := time.NewTicker(opts.Interval)
 	defer ticker.Stop()
 
-	var debounceTimer *time.Timer
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-	sync := func() {
-		log.Println("Sync triggered")
-		highlights, err := store.GetHighlightsSince(st.LastPK)
+	run := func(ctx context.Context, reasons []Reason) {
+		changed, err := snap.Refresh(ctx)
 		if err != nil {
-			log.Printf("ERROR: Failed to get highlights since PK %d: %v", st.LastPK, err)
+			log.Printf("ERROR: Failed to refresh snapshots: %v", err)
 			return
 		}
-
-		if len(highlights) == 0 {
-			log.Printf("No new highlights found since PK %d.", st.LastPK)
-			return
-		}
-
-		bookDataMap := make(map[string]*exporter.BookData)
-		var highlightsCount int
-		var maxPK int64 = st.LastPK
-		for _, h := range highlights {
-			bookKey := slug.Make(h.BookTitle)
-
-			if _, exists := bookDataMap[bookKey]; !exists {
-				bookDataMap[bookKey] = &exporter.BookData{
-					Title:      h.BookTitle,
-					Author:     h.BookAuthor,
-					Highlights: []string{},
-				}
-			}
-			bookDataMap[bookKey].Highlights = append(bookDataMap[bookKey].Highlights, h.HighlightText)
-			highlightsCount++
-
-			if h.PK > maxPK {
-				maxPK = h.PK
-			}
-		}
-
-		log.Printf("Processing %d new highlight(s) across %d book(s) (max PK: %d)...", highlightsCount, len(bookDataMap), maxPK)
-
-		var exportErrors int
-		for _, data := range bookDataMap {
-			if err := exp.WriteBook(*data); err != nil {
-				log.Printf("ERROR: Failed to write book '%s': %v", data.Title, err)
-				exportErrors++
+		if changed {
+			if err := store.Reopen(); err != nil {
+				log.Printf("ERROR: %v", err)
+				return
 			}
 		}
 
-		if exportErrors > 0 {
-			log.Printf("Sync completed with %d errors.", exportErrors)
-		} else {
-			log.Printf("Sync completed successfully for %d book(s).", len(bookDataMap))
+		res, err := eng.Run(ctx)
+		if err != nil {
+			log.Printf("ERROR: Sync failed: %v", err)
+			return
 		}
-
-		if maxPK > st.LastPK {
-			log.Printf("Updating last PK from %d to %d", st.LastPK, maxPK)
-			st.LastPK = maxPK
-			if err := st.Save(); err != nil {
-				log.Printf("ERROR: Failed to save state after update: %v", err)
-			} else {
-				log.Printf("State saved successfully with last PK %d", st.LastPK)
-			}
+		if n := len(res.Errors); n > 0 {
+			log.Printf("Sync completed with %d errors. %d book(s) queued for retry.", n, res.Pending)
 		} else {
-			log.Printf("No update to last PK needed (still %d).", st.LastPK)
+			log.Printf("Sync completed successfully for %d book(s).", res.BooksWritten)
 		}
 	}
 
-	sync()
+	sched := NewScheduler(run, opts.Debounce)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sched.Run(ctx)
+	}()
+
+	sched.Trigger(ReasonStartup)
 
 	for {
 		select {
 		case ev := <-w.Events:
-			if ev.Name == st.Path && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+			if isSourceEvent(snap.Sources(), ev) {
 				log.Printf("File event detected: %s on %s", ev.Op, ev.Name)
-				if debounceTimer != nil {
-					debounceTimer.Stop()
-				}
-				debounceTimer = time.AfterFunc(2*time.Second, sync)
+				sched.Debounce(ReasonFSEvent)
 			}
 		case err := <-w.Errors:
 			log.Printf("Watcher error: %v", err)
 		case <-ticker.C:
-			log.Println("Periodic sync triggered by ticker")
-			sync()
+			sched.Trigger(ReasonTicker)
+		case <-hup:
+			log.Println("SIGHUP received")
+			sched.Trigger(ReasonSignal, ReasonManual)
 		case <-ctx.Done():
 			log.Println("Watcher context cancelled, shutting down.")
-			if debounceTimer != nil {
-				debounceTimer.Stop()
-			}
+			// Let a run in progress finish before returning.
+			<-done
 			return ctx.Err()
 		}
 	}
 }
+
+// isSourceEvent reports whether ev is a write to one of the live databases or
+// their WAL files. Changes to the shared-memory index are ignored, and so is
+// the creation of an empty WAL, as SQLite does both on reads too.
+func isSourceEvent(sources []snapshot.Source, ev fsnotify.Event) bool {
+	for _, src := range sources {
+		switch ev.Name {
+		case src.Path:
+			return ev.Op&(fsnotify.Write|fsnotify.Create) != 0
+		case src.Path + "-wal":
+			return ev.Op&fsnotify.Write != 0
+		}
+	}
+	return false
+}
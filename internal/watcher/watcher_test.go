@@ -0,0 +1,102 @@
+package watcher
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation"
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+	"github.com/naimoon6450/booksync/internal/exporter"
+	"github.com/naimoon6450/booksync/internal/snapshot"
+	"github.com/naimoon6450/booksync/internal/state"
+	booksync "github.com/naimoon6450/booksync/internal/sync"
+)
+
+// TestWatchAndSyncPicksUpWrites points the watcher at fixture databases in a
+// temporary directory, standing in for the Apple Books container, and checks
+// that a write to them is snapshotted and synced.
+func TestWatchAndSyncPicksUpWrites(t *testing.T) {
+	prev := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer."})
+
+	snapDir := t.TempDir()
+	annSnap := filepath.Join(snapDir, annotationtest.AnnotationFile)
+	libSnap := filepath.Join(snapDir, annotationtest.LibraryFile)
+	snap := snapshot.New(
+		snapshot.Source{Path: fx.AnnotationPath, Dest: annSnap},
+		snapshot.Source{Path: fx.LibraryPath, Dest: libSnap},
+	)
+	if _, err := snap.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store, err := annotation.NewStore(annSnap, libSnap, annotation.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	vault := t.TempDir()
+	tpl := filepath.Join(t.TempDir(), "note.tmpl")
+	if err := os.WriteFile(tpl, []byte("{{ range .Highlights }}- {{ .Text }}\n{{ end }}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	exp, err := exporter.New(vault, tpl, exporter.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := state.Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- WatchAndSync(ctx, store, snap, booksync.New(store, st, exp), Options{Debounce: 50 * time.Millisecond, Interval: time.Hour})
+	}()
+	defer cancel()
+
+	note := filepath.Join(vault, "apple_books_sync", "dune.md")
+	waitFor := func(text string) {
+		t.Helper()
+		deadline := time.After(10 * time.Second)
+		for {
+			if b, err := os.ReadFile(note); err == nil && strings.Contains(string(b), text) {
+				return
+			}
+			select {
+			case err := <-errc:
+				t.Fatalf("WatchAndSync returned early: %v", err)
+			case <-deadline:
+				t.Fatalf("timed out waiting for %q in the note", text)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+
+	waitFor("- Fear is the mind-killer.")
+
+	// The new highlight only reaches the store through a fresh snapshot.
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "The spice must flow."})
+	waitFor("- The spice must flow.")
+
+	// Cancelling waits for the run in progress, which records H2.
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("WatchAndSync returned %v, want context.Canceled", err)
+	}
+	if _, ok := st.Annotations["H2"]; !ok {
+		t.Error("H2 was not recorded in the state")
+	}
+}
@@ -0,0 +1,248 @@
+package applebooks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation"
+)
+
+// ErrNotFound is returned when a requested book is not in the library.
+var ErrNotFound = errors.New("applebooks: not found")
+
+// Colour is the highlight colour of an annotation.
+type Colour string
+
+const (
+	ColourUnderline Colour = "underline"
+	ColourGreen     Colour = "green"
+	ColourBlue      Colour = "blue"
+	ColourYellow    Colour = "yellow"
+	ColourPink      Colour = "pink"
+	ColourPurple    Colour = "purple"
+	ColourUnknown   Colour = "unknown"
+)
+
+// Book is a book in the Apple Books library.
+type Book struct {
+	AssetID string
+	Title   string
+	Author  string
+	// Annotations is the number of live annotations in the book. It is only
+	// set by Library.Books.
+	Annotations int
+}
+
+// Annotation is a highlight, with its note if it has one.
+type Annotation struct {
+	// ID is the annotation's UUID, stable across database rebuilds.
+	ID      string
+	AssetID string
+	// When the book is missing from the library, BookTitle is the asset ID
+	// and BookAuthor is empty; see UnknownBook.
+	BookTitle  string
+	BookAuthor string
+	// UnknownBook is set when the annotated asset is not in the library
+	// database, such as a PDF or a book that has since been removed.
+	UnknownBook bool
+	Text        string
+	Note        string
+	Colour      Colour
+	Underline   bool
+	Created     time.Time
+	Modified    time.Time
+	// Location is the EPUB CFI of the highlighted range.
+	Location string
+	// Deleted is set on annotations returned by Library.Deleted.
+	Deleted bool
+}
+
+// Filter narrows the annotations returned by Library.Annotations and
+// Library.All. The zero Filter matches every live annotation.
+type Filter struct {
+	// AssetID limits results to one book.
+	AssetID string
+	// Since limits results to annotations modified after it.
+	Since time.Time
+	// Colours limits results to annotations with one of these colours.
+	Colours []Colour
+}
+
+func (f Filter) match(a Annotation) bool {
+	if f.AssetID != "" && a.AssetID != f.AssetID {
+		return false
+	}
+	if !f.Since.IsZero() && !a.Modified.After(f.Since) {
+		return false
+	}
+	if len(f.Colours) > 0 && !slices.Contains(f.Colours, a.Colour) {
+		return false
+	}
+	return true
+}
+
+// Library is an open pair of Apple Books databases. It is safe for
+// concurrent use.
+type Library struct {
+	store *annotation.Store
+}
+
+// Open opens the annotation database (AEAnnotation*.sqlite) and the library
+// database (BKLibrary*.sqlite) read-only.
+func Open(annotationPath, libraryPath string) (*Library, error) {
+	store, err := annotation.NewStore(annotationPath, libraryPath, annotation.Options{
+		// Errors are returned; the caller's logger is left alone.
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Library{store: store}, nil
+}
+
+// Close closes the databases.
+func (l *Library) Close() error {
+	return l.store.Close()
+}
+
+func annotationFrom(h *annotation.Highlight) Annotation {
+	return Annotation{
+		ID:          h.Key(),
+		AssetID:     h.AssetID,
+		BookTitle:   h.BookTitle,
+		BookAuthor:  h.BookAuthor,
+		UnknownBook: h.UnknownBook,
+		Text:        h.HighlightText,
+		Note:        h.Note,
+		Colour:      Colour(h.Colour()),
+		Underline:   h.IsUnderline,
+		Created:     h.CreatedAt,
+		Modified:    h.ModifiedAt,
+		Location:    h.Location,
+	}
+}
+
+// Annotations returns the live annotations matching f, in the order Apple
+// Books stored them. That is usually the order they were created in, but
+// not after Apple Books rebuilt its database; sort by Created when the order
+// matters.
+func (l *Library) Annotations(f Filter) ([]Annotation, error) {
+	var out []Annotation
+	for a, err := range l.All(f) {
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// All iterates over the live annotations matching f, in the order Apple
+// Books stored them, like Annotations. Annotations are read from the database in pages as the iteration
+// proceeds, so large libraries are not loaded into memory at once. An error
+// ends the iteration.
+func (l *Library) All(f Filter) iter.Seq2[Annotation, error] {
+	return func(yield func(Annotation, error) bool) {
+		if f.AssetID != "" {
+			highlights, err := l.store.GetHighlightsForBook(f.AssetID)
+			if err != nil {
+				yield(Annotation{}, err)
+				return
+			}
+			for _, h := range highlights {
+				if a := annotationFrom(h); f.match(a) && !yield(a, nil) {
+					return
+				}
+			}
+			return
+		}
+
+		for h, err := range l.store.Highlights(0) {
+			if err != nil {
+				yield(Annotation{}, err)
+				return
+			}
+			if a := annotationFrom(h); f.match(a) && !yield(a, nil) {
+				return
+			}
+		}
+	}
+}
+
+// AnnotationsForBook returns the live annotations of one book.
+func (l *Library) AnnotationsForBook(assetID string) ([]Annotation, error) {
+	return l.Annotations(Filter{AssetID: assetID})
+}
+
+// AnnotationsSince returns the live annotations modified after t.
+func (l *Library) AnnotationsSince(t time.Time) ([]Annotation, error) {
+	return l.Annotations(Filter{Since: t})
+}
+
+// AnnotationsByColour returns the live annotations with one of the colours.
+func (l *Library) AnnotationsByColour(colours ...Colour) ([]Annotation, error) {
+	return l.Annotations(Filter{Colours: colours})
+}
+
+// Deleted returns the annotations Apple Books has marked as deleted but not
+// yet purged from its database.
+func (l *Library) Deleted() ([]Annotation, error) {
+	highlights, err := l.store.GetDeletedHighlights()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Annotation, 0, len(highlights))
+	for _, h := range highlights {
+		a := annotationFrom(h)
+		a.Deleted = true
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// Book looks up a book by its asset ID. It returns ErrNotFound if the book is
+// not in the library.
+func (l *Library) Book(assetID string) (Book, error) {
+	book, unknown, err := l.store.GetBook(assetID)
+	if err != nil {
+		return Book{}, err
+	}
+	if unknown {
+		return Book{}, fmt.Errorf("book %s: %w", assetID, ErrNotFound)
+	}
+	return Book{AssetID: assetID, Title: book.Title, Author: book.Author}, nil
+}
+
+// Books returns the books that have live annotations, sorted by title.
+func (l *Library) Books() ([]Book, error) {
+	byAsset := make(map[string]*Book)
+	for h, err := range l.store.Highlights(0) {
+		if err != nil {
+			return nil, err
+		}
+		b, ok := byAsset[h.AssetID]
+		if !ok {
+			b = &Book{AssetID: h.AssetID, Title: h.BookTitle, Author: h.BookAuthor}
+			byAsset[h.AssetID] = b
+		}
+		b.Annotations++
+	}
+
+	books := make([]Book, 0, len(byAsset))
+	for _, b := range byAsset {
+		books = append(books, *b)
+	}
+	sort.Slice(books, func(i, j int) bool {
+		if books[i].Title != books[j].Title {
+			return books[i].Title < books[j].Title
+		}
+		return books[i].AssetID < books[j].AssetID
+	})
+	return books, nil
+}
@@ -0,0 +1,202 @@
+package applebooks_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/naimoon6450/booksync/internal/annotation/annotationtest"
+	"github.com/naimoon6450/booksync/pkg/applebooks"
+)
+
+func TestLibraryDoesNotLog(t *testing.T) {
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer.", Style: 3})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H2", Text: "Gone.", Deleted: true})
+
+	var logged bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	lib, err := applebooks.Open(fx.AnnotationPath, fx.LibraryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+
+	all, err := lib.Annotations(applebooks.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].ID != "H1" || all[0].BookTitle != "Dune" || all[0].Colour != applebooks.ColourYellow {
+		t.Errorf("Annotations = %+v", all)
+	}
+	if got, err := lib.AnnotationsForBook("A1"); err != nil || len(got) != 1 {
+		t.Errorf("AnnotationsForBook = %v, %v", got, err)
+	}
+	if got, err := lib.Deleted(); err != nil || len(got) != 1 || !got[0].Deleted {
+		t.Errorf("Deleted = %v, %v", got, err)
+	}
+	if _, err := lib.Book("missing"); !errors.Is(err, applebooks.ErrNotFound) {
+		t.Errorf("Book(missing) error = %v, want ErrNotFound", err)
+	}
+	if _, err := lib.Books(); err != nil {
+		t.Error(err)
+	}
+
+	if logged.Len() > 0 {
+		t.Errorf("the package wrote to the standard logger:\n%s", logged.String())
+	}
+}
+
+// library opens a library of two books, an orphaned asset and a deleted
+// annotation. Annotations are stored out of creation order.
+func library(t *testing.T) *applebooks.Library {
+	t.Helper()
+	day := func(n int) time.Time { return time.Date(2024, time.June, n, 9, 0, 0, 0, time.UTC) }
+	fx := annotationtest.New(t, t.TempDir())
+	fx.AddBook("A1", "Dune", "Frank Herbert")
+	fx.AddBook("A2", "Emma", "Jane Austen")
+	fx.AddBook("A3", "Walden", "Henry David Thoreau")
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H1", Text: "Fear is the mind-killer.", Style: 3, Created: day(5)})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A2", UUID: "H2", Text: "Badly done, Emma!", Style: 1, Created: day(1), Modified: day(10)})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H3", Text: "The spice must flow.", Note: "Motto", Style: 0, Created: day(3), Location: "epubcfi(/6/4!/4/2/1:0)"})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "ORPHAN", UUID: "H4", Text: "A scanned page.", Style: 4, Created: day(2)})
+	fx.AddHighlight(annotationtest.Highlight{AssetID: "A1", UUID: "H5", Text: "Gone.", Style: 3, Created: day(4), Deleted: true})
+
+	lib, err := applebooks.Open(fx.AnnotationPath, fx.LibraryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lib.Close() })
+	return lib
+}
+
+// ids returns the IDs of annotations, or the error in their place.
+func ids(all []applebooks.Annotation, err error) []string {
+	if err != nil {
+		return []string{err.Error()}
+	}
+	out := []string{}
+	for _, a := range all {
+		out = append(out, a.ID)
+	}
+	return out
+}
+
+func TestAnnotationsFilter(t *testing.T) {
+	lib := library(t)
+	tests := []struct {
+		name   string
+		filter applebooks.Filter
+		want   []string
+	}{
+		{"all live, in stored order", applebooks.Filter{}, []string{"H1", "H2", "H3", "H4"}},
+		{"one book", applebooks.Filter{AssetID: "A1"}, []string{"H1", "H3"}},
+		{"missing book", applebooks.Filter{AssetID: "A9"}, []string{}},
+		{"modified after", applebooks.Filter{Since: time.Date(2024, time.June, 4, 0, 0, 0, 0, time.UTC)}, []string{"H1", "H2"}},
+		{"modified exactly at is excluded", applebooks.Filter{Since: time.Date(2024, time.June, 10, 9, 0, 0, 0, time.UTC)}, []string{}},
+		{"colours", applebooks.Filter{Colours: []applebooks.Colour{applebooks.ColourYellow, applebooks.ColourUnderline}}, []string{"H1", "H3"}},
+		{"combined", applebooks.Filter{AssetID: "A1", Colours: []applebooks.Colour{applebooks.ColourUnderline}}, []string{"H3"}},
+	}
+	for _, tt := range tests {
+		all, err := lib.Annotations(tt.filter)
+		if got := ids(all, err); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if got := ids(lib.AnnotationsByColour(applebooks.ColourPink)); !slices.Equal(got, []string{"H4"}) {
+		t.Errorf("AnnotationsByColour(pink) = %v", got)
+	}
+	if got := ids(lib.AnnotationsSince(time.Date(2024, time.June, 9, 0, 0, 0, 0, time.UTC))); !slices.Equal(got, []string{"H2"}) {
+		t.Errorf("AnnotationsSince = %v", got)
+	}
+}
+
+func TestAnnotationFields(t *testing.T) {
+	lib := library(t)
+	all, err := lib.AnnotationsForBook("A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("AnnotationsForBook(A1) = %+v", all)
+	}
+	a := all[1]
+	want := applebooks.Annotation{
+		ID: "H3", AssetID: "A1", BookTitle: "Dune", BookAuthor: "Frank Herbert",
+		Text: "The spice must flow.", Note: "Motto", Colour: applebooks.ColourUnderline, Underline: true,
+		Created: time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC), Modified: time.Date(2024, time.June, 3, 9, 0, 0, 0, time.UTC),
+		Location: "epubcfi(/6/4!/4/2/1:0)",
+	}
+	if !a.Created.Equal(want.Created) || !a.Modified.Equal(want.Modified) {
+		t.Errorf("dates = %v, %v, want %v", a.Created, a.Modified, want.Created)
+	}
+	a.Created, a.Modified = want.Created, want.Modified
+	if a != want {
+		t.Errorf("annotation = %+v\nwant %+v", a, want)
+	}
+
+	orphans, err := lib.AnnotationsForBook("ORPHAN")
+	if err != nil || len(orphans) != 1 || !orphans[0].UnknownBook || orphans[0].BookTitle != "ORPHAN" || orphans[0].BookAuthor != "" {
+		t.Errorf("orphaned annotation = %+v, %v", orphans, err)
+	}
+}
+
+func TestAllStopsEarly(t *testing.T) {
+	lib := library(t)
+	var got []string
+	for a, err := range lib.All(applebooks.Filter{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, a.ID)
+		if len(got) == 2 {
+			break
+		}
+	}
+	if !slices.Equal(got, []string{"H1", "H2"}) {
+		t.Errorf("All = %v", got)
+	}
+}
+
+func TestBooks(t *testing.T) {
+	lib := library(t)
+	books, err := lib.Books()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Walden has no annotations; the deleted one isn't counted.
+	want := []applebooks.Book{
+		{AssetID: "A1", Title: "Dune", Author: "Frank Herbert", Annotations: 2},
+		{AssetID: "A2", Title: "Emma", Author: "Jane Austen", Annotations: 1},
+		{AssetID: "ORPHAN", Title: "ORPHAN", Annotations: 1},
+	}
+	if !slices.Equal(books, want) {
+		t.Errorf("Books = %+v\nwant %+v", books, want)
+	}
+
+	if b, err := lib.Book("A3"); err != nil || b != (applebooks.Book{AssetID: "A3", Title: "Walden", Author: "Henry David Thoreau"}) {
+		t.Errorf("Book(A3) = %+v, %v", b, err)
+	}
+	if _, err := lib.Book("ORPHAN"); !errors.Is(err, applebooks.ErrNotFound) {
+		t.Errorf("Book(ORPHAN) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDeleted(t *testing.T) {
+	lib := library(t)
+	deleted, err := lib.Deleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != "H5" || !deleted[0].Deleted || deleted[0].Text != "Gone." || deleted[0].BookTitle != "Dune" {
+		t.Errorf("Deleted = %+v", deleted)
+	}
+}
@@ -0,0 +1,36 @@
+// Package applebooks reads highlights and notes from the Apple Books
+// databases on macOS.
+//
+// Apple Books keeps annotations in AEAnnotation*.sqlite and book metadata in
+// BKLibrary*.sqlite, under
+// ~/Library/Containers/com.apple.iBooksX/Data/Documents. Open both with
+// Open and query them through the returned Library:
+//
+//	lib, err := applebooks.Open(annotationPath, libraryPath)
+//	if err != nil {
+//		return err
+//	}
+//	defer lib.Close()
+//
+//	for a, err := range lib.All(applebooks.Filter{}) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(a.BookTitle, a.Text)
+//	}
+//
+// The databases are opened read-only. Apple Books writes to them while it
+// runs, so prefer reading a copy (booksync takes one with SQLite's backup
+// API) over the live files. The package doesn't log; failures are returned
+// as errors.
+//
+// # Compatibility
+//
+// This package follows semantic versioning with the booksync module: within
+// a major version, exported identifiers are not removed or changed in
+// incompatible ways. New fields may be added to Book, Annotation and Filter,
+// so construct them with field names rather than positionally. New Colour
+// values may appear as Apple Books adds styles; treat unrecognised ones as
+// ColourUnknown. The format of error messages is not part of the API; use
+// errors.Is with ErrNotFound instead.
+package applebooks